@@ -13,16 +13,32 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/l13t/github_rate_limit_exporter/internal/alerting"
+	"github.com/l13t/github_rate_limit_exporter/internal/broker"
 	"github.com/l13t/github_rate_limit_exporter/internal/collector"
 	"github.com/l13t/github_rate_limit_exporter/internal/config"
+	"github.com/l13t/github_rate_limit_exporter/internal/ingest"
+	"github.com/l13t/github_rate_limit_exporter/internal/probe"
+	"github.com/l13t/github_rate_limit_exporter/internal/proxy"
+	"github.com/l13t/github_rate_limit_exporter/internal/reload"
 )
 
 var (
-	configFile = flag.String("config", "config.yaml", "Path to configuration file (supports .yaml, .yml, .toml, .hcl)")
-	version    = "dev"
+	configFile    = flag.String("config", "config.yaml", "Path to configuration file (supports .yaml, .yml, .toml, .hcl)")
+	watchConfig   = flag.Bool("watch-config", false, "Reload the configuration file automatically when it changes")
+	watchInterval = flag.Duration("watch-interval", 5*time.Second, "Interval between configuration file checks when -watch-config is set")
+	lifecycle     = flag.Bool("web.enable-lifecycle", false, "Reload the configuration on POST or PUT requests to /-/reload")
+	version       = "dev"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if err := runRules(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to generate rules: %v", err)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	log.Printf("GitHub Rate Limit Exporter version %s", version)
@@ -33,23 +49,76 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	log.Printf("Loaded configuration with %d users", len(cfg.Users))
+	log.Printf("Loaded configuration with %d users and %d modules", len(cfg.Users), len(cfg.Modules))
 	log.Printf("Listen address: %s", cfg.ListenAddr)
 	log.Printf("Metrics path: %s", cfg.MetricsPath)
+	log.Printf("Collection mode: %s", cfg.CollectionMode)
 	log.Printf("Poll interval: %d seconds", cfg.PollInterval)
+	log.Printf("Poll workers: %d", cfg.PollWorkers)
+	log.Printf("Metric layout: %s", cfg.MetricLayout)
 
 	// Create collector
-	c := collector.NewCollector(cfg.Users)
+	c, err := collector.NewCollector(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create collector: %v", err)
+	}
 
 	// Register collector with Prometheus
 	prometheus.MustRegister(c)
 
+	// On-demand rate limits for a single account
+	prober := probe.NewHandler(cfg)
+
+	// Hands out the account with the most remaining quota
+	tokenBroker := broker.New(cfg.Broker, c)
+	prometheus.MustRegister(tokenBroker)
+
+	// Forwards GitHub API requests, recording the rate limits of the responses
+	apiProxy := proxy.New(cfg, c)
+	prometheus.MustRegister(apiProxy)
+
+	// Takes rate limits reported by clients that call GitHub themselves
+	ingester := ingest.NewHandler(cfg, c)
+	prometheus.MustRegister(ingester)
+
+	// Notifies webhooks when alert rules fire and resolve
+	alerter := alerting.New(cfg.Alerting, c)
+	prometheus.MustRegister(alerter)
+	c.OnUpdate(func() { alerter.Evaluate(time.Now()) })
+
+	// Reload configuration on SIGHUP, and on POST /-/reload if enabled
+	reloader := reload.NewReloader(*configFile, func(newCfg *config.Config) error {
+		warnRestartRequired(cfg, newCfg)
+		if err := c.Reload(newCfg); err != nil {
+			return err
+		}
+		prober.Reload(newCfg)
+		tokenBroker.Reload(newCfg.Broker)
+		apiProxy.Reload(newCfg)
+		ingester.Reload(newCfg)
+		alerter.Reload(newCfg.Alerting)
+		return nil
+	})
+	prometheus.MustRegister(reloader)
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start background polling
-	go c.StartPolling(ctx, time.Duration(cfg.PollInterval)*time.Second)
+	// Start background polling, unless rate limits are fetched on scrape
+	if cfg.CollectionMode == config.CollectionModePoll {
+		go c.StartPolling(ctx, time.Duration(cfg.PollInterval)*time.Second)
+	}
+
+	go alerter.Run(ctx)
+
+	if *watchConfig {
+		if *watchInterval <= 0 {
+			log.Fatalf("Invalid -watch-interval: %s", *watchInterval)
+		}
+		log.Printf("Watching %s for changes every %s", *configFile, *watchInterval)
+		go reloader.Watch(ctx, *watchInterval)
+	}
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
@@ -65,6 +134,14 @@ func main() {
 </html>`))
 	})
 
+	// The endpoint is unauthenticated, so it's only served on request
+	if *lifecycle {
+		mux.Handle("/-/reload", reloader)
+	}
+	mux.Handle("/probe", prober)
+	mux.Handle(broker.PathPrefix, tokenBroker)
+	mux.Handle(ingest.Path, ingester)
+
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -86,10 +163,36 @@ func main() {
 		}
 	}()
 
-	// Wait for interrupt signal
+	// The proxy gets its own listener so GitHub clients can use it as base URL
+	var proxyServer *http.Server
+	if cfg.Proxy != nil {
+		proxyServer = &http.Server{
+			Addr:        cfg.Proxy.ListenAddr,
+			Handler:     apiProxy,
+			ReadTimeout: 30 * time.Second,
+			// Leave time for slow GitHub responses, e.g. large archives
+			WriteTimeout: 5 * time.Minute,
+			IdleTimeout:  60 * time.Second,
+		}
+
+		go func() {
+			log.Printf("Starting proxy server on %s", cfg.Proxy.ListenAddr)
+			if err := proxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Proxy server error: %v", err)
+			}
+		}()
+	}
+
+	// Wait for interrupt signal, reloading on SIGHUP
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("Received SIGHUP, reloading configuration")
+		reloader.Reload()
+	}
 
 	log.Println("Shutting down...")
 
@@ -103,6 +206,37 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
+	if proxyServer != nil {
+		if err := proxyServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Proxy server shutdown error: %v", err)
+		}
+	}
 
 	log.Println("Exporter stopped")
 }
+
+// warnRestartRequired logs settings that changed in the reloaded configuration
+// but only take effect after a restart
+func warnRestartRequired(cfg, newCfg *config.Config) {
+	if newCfg.ListenAddr != cfg.ListenAddr {
+		log.Printf("Ignoring listen_addr change to %s until restart", newCfg.ListenAddr)
+	}
+	if newCfg.MetricsPath != cfg.MetricsPath {
+		log.Printf("Ignoring metrics_path change to %s until restart", newCfg.MetricsPath)
+	}
+	if newCfg.PollInterval != cfg.PollInterval {
+		log.Printf("Ignoring poll_interval change to %d until restart", newCfg.PollInterval)
+	}
+	if newCfg.PollWorkers != cfg.PollWorkers {
+		log.Printf("Ignoring poll_workers change to %d until restart", newCfg.PollWorkers)
+	}
+	if newCfg.CollectionMode != cfg.CollectionMode {
+		log.Printf("Ignoring collection_mode change to %s until restart", newCfg.CollectionMode)
+	}
+	if newCfg.MetricLayout != cfg.MetricLayout {
+		log.Printf("Ignoring metric_layout change to %s until restart", newCfg.MetricLayout)
+	}
+	if newCfg.Proxy != nil && (cfg.Proxy == nil || newCfg.Proxy.ListenAddr != cfg.Proxy.ListenAddr) {
+		log.Printf("Ignoring proxy listen_addr change to %s until restart", newCfg.Proxy.ListenAddr)
+	}
+}
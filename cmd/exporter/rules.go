@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+	"github.com/l13t/github_rate_limit_exporter/internal/rules"
+)
+
+// labelFlags collects repeated key=value flags
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value, got %q", s)
+	}
+	l[key] = value
+	return nil
+}
+
+// runRules prints Prometheus alert rules generated from the configuration
+func runRules(args []string) error {
+	fs := flag.NewFlagSet("rules", flag.ExitOnError)
+	configFile := fs.String("config", "config.yaml", "Path to configuration file (supports .yaml, .yml, .toml, .hcl)")
+	format := fs.String("format", rules.FormatRules, "Output format, rules for a Prometheus rules file or prometheusrule for a Prometheus Operator resource")
+	output := fs.String("output", "-", "File to write the rules to, - for stdout")
+	name := fs.String("name", "github-rate-limit-exporter", "Name of the PrometheusRule resource")
+	namespace := fs.String("namespace", "", "Namespace of the PrometheusRule resource")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "Label of the PrometheusRule resource as key=value, may be repeated")
+	fs.Parse(args)
+
+	// Rules only need the accounts, so secrets needn't be available
+	cfg, err := config.LoadConfigWithoutCredentials(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	group, err := rules.Generate(cfg)
+	if err != nil {
+		return err
+	}
+
+	var doc any
+	switch *format {
+	case rules.FormatRules:
+		doc = rules.File{Groups: []rules.RuleGroup{group}}
+	case rules.FormatPrometheusRule:
+		meta := rules.Metadata{Name: *name, Namespace: *namespace}
+		if len(labels) > 0 {
+			meta.Labels = labels
+		}
+		doc = rules.NewPrometheusRule(meta, group)
+	default:
+		return fmt.Errorf("unknown format %q, must be %s or %s", *format, rules.FormatRules, rules.FormatPrometheusRule)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := rules.Encode(w, doc); err != nil {
+		return fmt.Errorf("failed to write rules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package alerting
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Notification states
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// statePending is the state label of alerts whose condition hasn't held long
+// enough to fire
+const statePending = "pending"
+
+// QuotaSource provides the last known rate limits of the accounts and groups
+type QuotaSource interface {
+	Quotas(resource string) []collector.Quota
+	GroupQuotas(resource string) []collector.GroupQuota
+}
+
+// Notification is the JSON body POSTed to webhooks. ID is the same for every
+// notification of an alert, so receivers can tell retried deliveries apart.
+type Notification struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Rule      string            `json:"rule"`
+	User      string            `json:"user,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Group     string            `json:"group,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Resource  string            `json:"resource"`
+	Limit     int               `json:"limit"`
+	Remaining int               `json:"remaining"`
+	Reset     time.Time         `json:"reset,omitzero"`
+	Summary   string            `json:"summary"`
+	StartsAt  time.Time         `json:"starts_at"`
+	EndsAt    time.Time         `json:"ends_at,omitzero"`
+}
+
+// alert is the state of a rule for one account or group whose condition holds
+type alert struct {
+	rule string
+	// since is when the condition started to hold
+	since  time.Time
+	firing bool
+	// last is the notification for the latest evaluation
+	last Notification
+}
+
+// Engine evaluates alert rules against the last known rate limits and
+// notifies webhooks when an alert starts firing and when it resolves. Each
+// alert is notified once per state change; failed deliveries are retried
+// from a queue per webhook, in order.
+type Engine struct {
+	quotas QuotaSource
+	cfg    *config.Alerting
+
+	// alerts are keyed by notification ID
+	alerts map[string]*alert
+	// queues are keyed by webhook URL
+	queues map[string]*queue
+	client *http.Client
+	wake   chan struct{}
+
+	// Prometheus metrics
+	alertsGauge   *prometheus.GaugeVec
+	notifications *prometheus.CounterVec
+	queueLength   prometheus.Gauge
+
+	mu sync.Mutex
+}
+
+// New creates an alert engine for the accounts in quotas. A nil cfg disables
+// it until a configuration with an alerting section is loaded.
+func New(cfg *config.Alerting, quotas QuotaSource) *Engine {
+	e := &Engine{
+		quotas: quotas,
+		alerts: make(map[string]*alert),
+		queues: make(map[string]*queue),
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+
+	e.alertsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_alerts",
+			Help: "Number of alerts of the rule by state, pending until its for duration has passed",
+		},
+		[]string{"rule", "state"},
+	)
+
+	e.notifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_alert_notifications_total",
+			Help: "Total number of alert notifications by status and delivery result",
+		},
+		[]string{"status", "result"},
+	)
+
+	e.queueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_alert_queue_length",
+			Help: "Number of alert notifications waiting to be delivered across all webhooks",
+		},
+	)
+
+	e.Reload(cfg)
+
+	return e
+}
+
+// Reload replaces the rules and webhooks. Alerts of rules that still exist
+// keep their state; firing alerts of removed rules are resolved. Queued
+// notifications of removed webhooks are dropped.
+func (e *Engine) Reload(cfg *config.Alerting) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cfg = cfg
+
+	keep := make(map[string]bool)
+	if cfg != nil {
+		for _, webhook := range cfg.Webhooks {
+			keep[webhook.URL] = true
+			if q, ok := e.queues[webhook.URL]; ok {
+				// Headers may have changed
+				q.webhook = webhook
+			} else {
+				e.queues[webhook.URL] = &queue{webhook: webhook}
+			}
+		}
+	}
+	for url, q := range e.queues {
+		if !keep[url] {
+			for _, d := range q.pending {
+				e.notifications.WithLabelValues(d.status, resultDropped).Inc()
+			}
+			delete(e.queues, url)
+		}
+	}
+
+	rules := make(map[string]bool)
+	if cfg != nil {
+		for _, rule := range cfg.Rules {
+			rules[rule.Name] = true
+		}
+	}
+	now := time.Now()
+	for id, a := range e.alerts {
+		if !rules[a.rule] {
+			e.resolve(id, a, now)
+		}
+	}
+
+	e.updateQueueLength()
+	e.updateAlerts()
+}
+
+// Evaluate checks every rule against the last known rate limits. It's called
+// after every update of the collector.
+func (e *Engine) Evaluate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cfg == nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range e.cfg.Rules {
+		for _, n := range e.subjects(rule, now) {
+			seen[n.ID] = true
+			e.evaluate(rule, n, now)
+		}
+	}
+
+	// Accounts and groups that are gone or lost their state can't be low
+	for id, a := range e.alerts {
+		if !seen[id] {
+			e.resolve(id, a, now)
+		}
+	}
+
+	e.updateAlerts()
+}
+
+// subjects returns the current state of everything a rule watches, as the
+// notification it would send
+func (e *Engine) subjects(rule config.AlertRule, now time.Time) []Notification {
+	var subjects []Notification
+
+	if rule.Group != "" {
+		for _, g := range e.quotas.GroupQuotas(rule.Resource) {
+			if g.Group != rule.Group {
+				continue
+			}
+			subjects = append(subjects, Notification{
+				ID:        rule.Name + "/group/" + g.Group,
+				Rule:      rule.Name,
+				Group:     g.Group,
+				Resource:  g.Resource,
+				Limit:     g.Limit,
+				Remaining: g.Remaining,
+				Reset:     g.Reset,
+				Summary: fmt.Sprintf("Group %s has %d of %d %s requests remaining across %d members",
+					g.Group, g.Remaining, g.Limit, g.Resource, g.Members),
+			})
+		}
+		return subjects
+	}
+
+	for _, q := range e.quotas.Quotas(rule.Resource) {
+		if !rule.Matches(q.User) {
+			continue
+		}
+		q.Remaining = q.RemainingAt(now)
+		subjects = append(subjects, Notification{
+			ID:        rule.Name + "/" + q.User.Key(),
+			Rule:      rule.Name,
+			User:      q.User.Name,
+			Host:      q.User.Host(),
+			Labels:    q.User.Labels,
+			Resource:  q.Resource,
+			Limit:     q.Limit,
+			Remaining: q.Remaining,
+			Reset:     q.Reset,
+			Summary: fmt.Sprintf("User %s on %s has %d of %d %s requests remaining",
+				q.User.Name, q.User.Host(), q.Remaining, q.Limit, q.Resource),
+		})
+	}
+	return subjects
+}
+
+// below reports whether a rule's condition holds
+func below(rule config.AlertRule, limit, remaining int) bool {
+	if rule.RemainingBelowPercent > 0 {
+		return limit > 0 && float64(remaining)*100/float64(limit) < rule.RemainingBelowPercent
+	}
+	return remaining < rule.RemainingBelow
+}
+
+// evaluate moves the alert of a subject on: pending once its condition holds,
+// firing once it held for the rule's duration, resolved once it stops holding
+func (e *Engine) evaluate(rule config.AlertRule, n Notification, now time.Time) {
+	a, ok := e.alerts[n.ID]
+	if ok {
+		n.StartsAt = a.last.StartsAt
+	}
+
+	if !below(rule, n.Limit, n.Remaining) {
+		if ok {
+			a.last = n
+			e.resolve(n.ID, a, now)
+		}
+		return
+	}
+
+	if !ok {
+		a = &alert{rule: rule.Name, since: now}
+		e.alerts[n.ID] = a
+	}
+	a.last = n
+
+	if !a.firing && now.Sub(a.since) >= time.Duration(rule.For)*time.Second {
+		a.firing = true
+		a.last.StartsAt = now
+		log.Printf("Alert %s is firing: %s", n.ID, n.Summary)
+		e.notify(StatusFiring, a.last)
+	}
+}
+
+// resolve forgets an alert, notifying webhooks if it was firing
+func (e *Engine) resolve(id string, a *alert, now time.Time) {
+	delete(e.alerts, id)
+	if !a.firing {
+		return
+	}
+
+	n := a.last
+	n.EndsAt = now
+	log.Printf("Alert %s is resolved", id)
+	e.notify(StatusResolved, n)
+}
+
+// updateAlerts exports the number of alerts per rule and state
+func (e *Engine) updateAlerts() {
+	e.alertsGauge.Reset()
+	if e.cfg == nil {
+		return
+	}
+
+	for _, rule := range e.cfg.Rules {
+		e.alertsGauge.WithLabelValues(rule.Name, statePending).Set(0)
+		e.alertsGauge.WithLabelValues(rule.Name, StatusFiring).Set(0)
+	}
+	for _, a := range e.alerts {
+		state := statePending
+		if a.firing {
+			state = StatusFiring
+		}
+		e.alertsGauge.WithLabelValues(a.rule, state).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (e *Engine) Describe(ch chan<- *prometheus.Desc) {
+	e.alertsGauge.Describe(ch)
+	e.notifications.Describe(ch)
+	e.queueLength.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (e *Engine) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.alertsGauge.Collect(ch)
+	e.notifications.Collect(ch)
+	e.queueLength.Collect(ch)
+}
@@ -0,0 +1,210 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// fakeQuotas is a QuotaSource with fixed states
+type fakeQuotas struct {
+	users  []collector.Quota
+	groups []collector.GroupQuota
+}
+
+func (f *fakeQuotas) Quotas(resource string) []collector.Quota {
+	var quotas []collector.Quota
+	for _, q := range f.users {
+		if q.Resource == resource {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas
+}
+
+func (f *fakeQuotas) GroupQuotas(resource string) []collector.GroupQuota {
+	var quotas []collector.GroupQuota
+	for _, g := range f.groups {
+		if g.Resource == resource {
+			quotas = append(quotas, g)
+		}
+	}
+	return quotas
+}
+
+// webhookRecorder is a webhook that records notifications, failing the first
+// failures requests
+type webhookRecorder struct {
+	failures      int
+	mu            sync.Mutex
+	requests      int
+	notifications []Notification
+	headers       []http.Header
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.requests++
+	if w.requests <= w.failures {
+		http.Error(rw, "Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var n Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		http.Error(rw, "Bad request", http.StatusBadRequest)
+		return
+	}
+	w.notifications = append(w.notifications, n)
+	w.headers = append(w.headers, r.Header)
+}
+
+func newTestEngine(t *testing.T, rule config.AlertRule, quotas *fakeQuotas, failures int) (*Engine, *webhookRecorder) {
+	t.Helper()
+
+	rec := &webhookRecorder{failures: failures}
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+
+	if rule.Resource == "" {
+		rule.Resource = "core"
+	}
+	e := New(&config.Alerting{
+		Rules:      []config.AlertRule{rule},
+		Webhooks:   []config.Webhook{{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}},
+		MaxRetries: 2,
+		QueueSize:  10,
+	}, quotas)
+
+	return e, rec
+}
+
+func TestEngine_FiringAndResolved(t *testing.T) {
+	now := time.Now()
+	user := config.User{Name: "ci-bot", Token: "token", Labels: map[string]string{"team": "platform"}}
+	quotas := &fakeQuotas{users: []collector.Quota{
+		{User: user, Resource: "core", Limit: 5000, Remaining: 400, Reset: now.Add(time.Hour)},
+	}}
+	e, rec := newTestEngine(t, config.AlertRule{Name: "core-low", RemainingBelowPercent: 10, For: 60}, quotas, 0)
+	ctx := context.Background()
+
+	// Pending until the condition held for a minute
+	e.Evaluate(now)
+	if v := testutil.ToFloat64(e.alertsGauge.WithLabelValues("core-low", statePending)); v != 1 {
+		t.Errorf("Expected 1 pending alert, got %v", v)
+	}
+	e.deliver(ctx, now)
+	if len(rec.notifications) != 0 {
+		t.Fatalf("Expected no notification while pending, got %d", len(rec.notifications))
+	}
+
+	// Fires once, however often it's evaluated
+	e.Evaluate(now.Add(time.Minute))
+	e.Evaluate(now.Add(2 * time.Minute))
+	e.deliver(ctx, now.Add(2*time.Minute))
+
+	quotas.users[0].Remaining = 4000
+	e.Evaluate(now.Add(3 * time.Minute))
+	e.deliver(ctx, now.Add(3*time.Minute))
+
+	if len(rec.notifications) != 2 {
+		t.Fatalf("Expected a firing and a resolved notification, got %+v", rec.notifications)
+	}
+	firing, resolved := rec.notifications[0], rec.notifications[1]
+	if firing.Status != StatusFiring || firing.ID != "core-low/api.github.com/ci-bot" || firing.Remaining != 400 || firing.Labels["team"] != "platform" {
+		t.Errorf("Unexpected firing notification: %+v", firing)
+	}
+	if resolved.Status != StatusResolved || resolved.ID != firing.ID || resolved.Remaining != 4000 ||
+		!resolved.StartsAt.Equal(firing.StartsAt) || resolved.EndsAt.IsZero() {
+		t.Errorf("Unexpected resolved notification: %+v", resolved)
+	}
+	if got := rec.headers[0].Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Expected webhook headers to be sent, got %q", got)
+	}
+	if v := testutil.ToFloat64(e.notifications.WithLabelValues(StatusResolved, resultSent)); v != 1 {
+		t.Errorf("Expected 1 resolved notification sent, got %v", v)
+	}
+}
+
+func TestEngine_Retry(t *testing.T) {
+	now := time.Now()
+	quotas := &fakeQuotas{users: []collector.Quota{
+		{User: config.User{Name: "ci-bot", Token: "token"}, Resource: "core", Limit: 5000, Remaining: 10, Reset: now.Add(time.Hour)},
+	}}
+	e, rec := newTestEngine(t, config.AlertRule{Name: "core-low", RemainingBelow: 100}, quotas, 2)
+	ctx := context.Background()
+
+	e.Evaluate(now)
+	quotas.users[0].Remaining = 5000
+	e.Evaluate(now)
+
+	// The resolved notification waits behind the failing firing one
+	if wait := e.deliver(ctx, now); wait != minRetryDelay {
+		t.Errorf("Expected a retry after %s, got %s", minRetryDelay, wait)
+	}
+	e.deliver(ctx, now.Add(time.Second))
+	if rec.requests != 1 {
+		t.Errorf("Expected no attempt before the retry is due, got %d requests", rec.requests)
+	}
+	e.deliver(ctx, now.Add(minRetryDelay))
+	e.deliver(ctx, now.Add(3*minRetryDelay))
+	e.deliver(ctx, now.Add(3*minRetryDelay))
+
+	if len(rec.notifications) != 2 || rec.notifications[0].Status != StatusFiring || rec.notifications[1].Status != StatusResolved {
+		t.Fatalf("Expected firing then resolved after retries, got %+v", rec.notifications)
+	}
+	if v := testutil.ToFloat64(e.queueLength); v != 0 {
+		t.Errorf("Expected an empty queue, got %v", v)
+	}
+}
+
+func TestEngine_GiveUp(t *testing.T) {
+	now := time.Now()
+	quotas := &fakeQuotas{groups: []collector.GroupQuota{
+		{Group: "ci", Resource: "search", Members: 3, Limit: 90, Remaining: 2, Reset: now.Add(time.Minute)},
+	}}
+	e, rec := newTestEngine(t, config.AlertRule{Name: "search-low", Group: "ci", Resource: "search", RemainingBelow: 5}, quotas, 100)
+	ctx := context.Background()
+
+	e.Evaluate(now)
+	for i := range 3 {
+		e.deliver(ctx, now.Add(time.Duration(i)*maxRetryDelay))
+	}
+
+	if rec.requests != 3 {
+		t.Errorf("Expected 1 attempt and 2 retries, got %d requests", rec.requests)
+	}
+	if v := testutil.ToFloat64(e.notifications.WithLabelValues(StatusFiring, resultFailed)); v != 1 {
+		t.Errorf("Expected 1 failed notification, got %v", v)
+	}
+}
+
+func TestEngine_ReloadResolvesRemovedRules(t *testing.T) {
+	now := time.Now()
+	quotas := &fakeQuotas{users: []collector.Quota{
+		{User: config.User{Name: "ci-bot", Token: "token"}, Resource: "core", Limit: 5000, Remaining: 10, Reset: now.Add(time.Hour)},
+	}}
+	e, rec := newTestEngine(t, config.AlertRule{Name: "core-low", RemainingBelow: 100}, quotas, 0)
+	e.Evaluate(now)
+
+	cfg := *e.cfg
+	cfg.Rules = []config.AlertRule{{Name: "core-critical", Resource: "core", RemainingBelow: 5}}
+	e.Reload(&cfg)
+	e.deliver(context.Background(), now)
+	e.deliver(context.Background(), now)
+
+	if len(rec.notifications) != 2 || rec.notifications[1].Status != StatusResolved || rec.notifications[1].Rule != "core-low" {
+		t.Errorf("Expected the removed rule's alert to resolve, got %+v", rec.notifications)
+	}
+}
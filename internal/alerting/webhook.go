@@ -0,0 +1,217 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Delivery results used in the result label of
+// github_rate_limit_alert_notifications_total
+const (
+	resultSent    = "sent"
+	resultFailed  = "failed"
+	resultDropped = "dropped"
+)
+
+const (
+	// webhookTimeout bounds a single delivery attempt
+	webhookTimeout = 10 * time.Second
+
+	// minRetryDelay is the delay after the first failed delivery, doubled
+	// after each further one
+	minRetryDelay = 5 * time.Second
+
+	// maxRetryDelay bounds the delay between delivery attempts
+	maxRetryDelay = 5 * time.Minute
+
+	// idleWait is how long Run sleeps when nothing is queued, unless woken
+	idleWait = time.Minute
+)
+
+// queue holds the notifications waiting for a webhook, oldest first. Only
+// the oldest is attempted, so a webhook never sees an alert resolve before
+// it fired.
+type queue struct {
+	webhook config.Webhook
+	pending []*delivery
+}
+
+// delivery is a notification waiting to be POSTed
+type delivery struct {
+	status   string
+	body     []byte
+	attempts int
+	// next is when the next attempt is due
+	next time.Time
+}
+
+// notify queues a notification for every webhook
+func (e *Engine) notify(status string, n Notification) {
+	n.Status = status
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Error encoding notification for alert %s: %v", n.ID, err)
+		return
+	}
+
+	for _, q := range e.queues {
+		q.pending = append(q.pending, &delivery{status: status, body: body})
+		if len(q.pending) > e.cfg.QueueSize {
+			e.notifications.WithLabelValues(q.pending[0].status, resultDropped).Inc()
+			q.pending = q.pending[1:]
+		}
+	}
+	e.updateQueueLength()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// updateQueueLength exports the number of queued notifications
+func (e *Engine) updateQueueLength() {
+	n := 0
+	for _, q := range e.queues {
+		n += len(q.pending)
+	}
+	e.queueLength.Set(float64(n))
+}
+
+// Run delivers queued notifications until ctx is done
+func (e *Engine) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wake:
+		case <-timer.C:
+		}
+
+		wait := e.deliver(ctx, time.Now())
+		timer.Reset(wait)
+	}
+}
+
+// deliver attempts the oldest due notification of every webhook and returns
+// how long to wait until the next one is due
+func (e *Engine) deliver(ctx context.Context, now time.Time) time.Duration {
+	type attempt struct {
+		q *queue
+		d *delivery
+	}
+
+	e.mu.Lock()
+	var due []attempt
+	for _, q := range e.queues {
+		if len(q.pending) > 0 && !now.Before(q.pending[0].next) {
+			due = append(due, attempt{q: q, d: q.pending[0]})
+		}
+	}
+	e.mu.Unlock()
+
+	// Deliver without holding the lock, so evaluation isn't held up by slow
+	// webhooks
+	errs := make([]error, len(due))
+	for i, a := range due {
+		errs[i] = e.send(ctx, a.q.webhook, a.d.body)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, a := range due {
+		// The webhook may have been removed or the delivery dropped meanwhile
+		if len(a.q.pending) == 0 || a.q.pending[0] != a.d {
+			continue
+		}
+
+		if errs[i] == nil {
+			e.notifications.WithLabelValues(a.d.status, resultSent).Inc()
+			a.q.pending = a.q.pending[1:]
+			continue
+		}
+
+		a.d.attempts++
+		if a.d.attempts > e.maxRetries() {
+			log.Printf("Giving up on alert notification to %s after %d attempts: %v", redact(a.q.webhook.URL), a.d.attempts, errs[i])
+			e.notifications.WithLabelValues(a.d.status, resultFailed).Inc()
+			a.q.pending = a.q.pending[1:]
+			continue
+		}
+
+		delay := retryDelay(a.d.attempts)
+		a.d.next = now.Add(delay)
+		log.Printf("Error delivering alert notification to %s, retrying in %s: %v", redact(a.q.webhook.URL), delay, errs[i])
+	}
+	e.updateQueueLength()
+
+	wait := idleWait
+	for _, q := range e.queues {
+		if len(q.pending) > 0 {
+			wait = min(wait, q.pending[0].next.Sub(now))
+		}
+	}
+	return max(wait, 0)
+}
+
+// maxRetries returns how often a failed delivery is retried
+func (e *Engine) maxRetries() int {
+	if e.cfg == nil {
+		return 0
+	}
+	return e.cfg.MaxRetries
+}
+
+// retryDelay returns the delay before the next attempt after a number of
+// failed ones
+func retryDelay(attempts int) time.Duration {
+	if shift := attempts - 1; shift < 16 {
+		return min(minRetryDelay<<shift, maxRetryDelay)
+	}
+	return maxRetryDelay
+}
+
+// send POSTs a notification to a webhook
+func (e *Engine) send(ctx context.Context, webhook config.Webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// redact returns a webhook URL without its path and query, which often hold
+// secrets, for logging
+func redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Authorized checks the API token a request carries in its Authorization
+// header against the configured ones. Besides "Bearer", the "token" scheme
+// GitHub clients commonly send is accepted.
+func Authorized(r *http.Request, tokens []string) bool {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		token, ok = strings.CutPrefix(header, "token ")
+	}
+	if !ok || token == "" {
+		return false
+	}
+
+	// Compare against every token so the time taken doesn't reveal a match
+	match := false
+	for _, allowed := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			match = true
+		}
+	}
+
+	return match
+}
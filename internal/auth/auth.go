@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+	"golang.org/x/oauth2"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+const (
+	// jwtLifetime is how long an app JWT stays valid (GitHub allows at most 10 minutes)
+	jwtLifetime = 9 * time.Minute
+
+	// jwtClockSkew backdates the issued-at claim to tolerate clock drift
+	jwtClockSkew = 60 * time.Second
+
+	// tokenRequestTimeout bounds a single installation token request
+	tokenRequestTimeout = 30 * time.Second
+)
+
+// TokenSource returns an OAuth2 token source for the given user. Personal
+// access tokens are served as-is, GitHub App installations get tokens that are
+// minted on demand and refreshed before they expire.
+func TokenSource(user config.User) (oauth2.TokenSource, error) {
+	if !user.IsApp() {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: user.Token}), nil
+	}
+
+	// Configs not loaded from a file, e.g. in tests, leave the key unread
+	var (
+		key *rsa.PrivateKey
+		err error
+	)
+	if len(user.PrivateKey) > 0 {
+		key, err = parsePrivateKey(user.PrivateKey, user.PrivateKeyPath)
+	} else {
+		key, err = loadPrivateKey(user.PrivateKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", user.Name, err)
+	}
+
+	src := &appTokenSource{
+		user:           user,
+		appID:          user.AppID,
+		installationID: user.InstallationID,
+		key:            key,
+	}
+
+	return oauth2.ReuseTokenSource(nil, src), nil
+}
+
+// NewClient creates a GitHub client for the user, pointed at their Enterprise
+// Server instance when a base URL is configured
+func NewClient(user config.User, httpClient *http.Client) (*github.Client, error) {
+	client := github.NewClient(httpClient)
+	if !user.IsEnterprise() {
+		return client, nil
+	}
+
+	uploadURL := user.UploadURL
+	if uploadURL == "" {
+		uploadURL = user.BaseURL
+	}
+
+	client, err := client.WithEnterpriseURLs(user.BaseURL, uploadURL)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid enterprise URLs: %w", user.Name, err)
+	}
+
+	return client, nil
+}
+
+// appTokenSource mints GitHub App installation tokens
+type appTokenSource struct {
+	user           config.User
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+}
+
+// Token implements oauth2.TokenSource
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRequestTimeout)
+	defer cancel()
+
+	client, err := NewClient(s.user, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	it, _, err := client.WithAuthToken(jwt).Apps.CreateInstallationToken(ctx, s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create installation token for app %d: %w", s.appID, err)
+	}
+
+	token := &oauth2.Token{AccessToken: it.GetToken()}
+	if it.ExpiresAt != nil {
+		token.Expiry = it.ExpiresAt.Time
+	}
+
+	return token, nil
+}
+
+// jwt builds an RS256 signed JSON Web Token identifying the app
+func (s *appTokenSource) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(s.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign app JWT: %w", err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// loadPrivateKey reads a PEM encoded RSA private key (PKCS#1 or PKCS#8)
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	return parsePrivateKey(data, path)
+}
+
+// parsePrivateKey parses a PEM encoded RSA private key read from path
+func parsePrivateKey(data []byte, path string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key %s: no PEM data found", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an RSA key", path)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func writeTestKey(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	tmpfile, err := os.CreateTemp("", "app-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := pem.Encode(tmpfile, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tmpfile.Name()
+}
+
+func TestAppTokenSource_JWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadPrivateKey(writeTestKey(t, key))
+	if err != nil {
+		t.Fatalf("Failed to load private key: %v", err)
+	}
+
+	src := &appTokenSource{appID: 42, installationID: 7, key: loaded}
+	now := time.Unix(1700000000, 0)
+
+	jwt, err := src.jwt(now)
+	if err != nil {
+		t.Fatalf("Failed to build JWT: %v", err)
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 JWT segments, got %d", len(parts))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("JWT signature does not verify: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Issuer != "42" {
+		t.Errorf("Expected issuer '42', got '%s'", claims.Issuer)
+	}
+
+	if claims.IssuedAt >= now.Unix() {
+		t.Errorf("Expected issued-at before %d, got %d", now.Unix(), claims.IssuedAt)
+	}
+
+	if claims.ExpiresAt-now.Unix() > int64((10 * time.Minute).Seconds()) {
+		t.Errorf("Expected expiry within 10 minutes, got %d", claims.ExpiresAt)
+	}
+}
+
+func TestAppTokenSource_Token(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	exchanges := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// GitHub Enterprise Server serves the API below /api/v3
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app/installations/7/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		exchanges++
+
+		jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if !ok || len(parts) != 3 {
+			t.Errorf("Expected a bearer JWT, got %q", r.Header.Get("Authorization"))
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("JWT signature does not verify: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "ghs_installation", "expires_at": %q}`, expiry.Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	src, err := TokenSource(config.User{
+		Name:           "release-app",
+		BaseURL:        server.URL,
+		AppID:          42,
+		InstallationID: 7,
+		PrivateKeyPath: writeTestKey(t, key),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token source: %v", err)
+	}
+
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Failed to mint installation token: %v", err)
+	}
+	if token.AccessToken != "ghs_installation" {
+		t.Errorf("Expected token 'ghs_installation', got '%s'", token.AccessToken)
+	}
+	if !token.Expiry.Equal(expiry) {
+		t.Errorf("Expected expiry %s, got %s", expiry, token.Expiry)
+	}
+
+	// The token is reused until it expires
+	if _, err := src.Token(); err != nil {
+		t.Fatalf("Failed to reuse installation token: %v", err)
+	}
+	if exchanges != 1 {
+		t.Errorf("Expected 1 token exchange, got %d", exchanges)
+	}
+}
+
+func TestLoadPrivateKey_Invalid(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "app-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte("not a key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPrivateKey(tmpfile.Name()); err == nil {
+		t.Error("Expected error for invalid private key, got nil")
+	}
+}
@@ -0,0 +1,391 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/auth"
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// PathPrefix is where the broker API is mounted
+const PathPrefix = "/api/v1/broker/"
+
+// QuotaSource provides the last known rate limits of the accounts
+type QuotaSource interface {
+	Quotas(resource string) []collector.Quota
+}
+
+// Broker hands out the account with the most remaining quota for a resource.
+// Every handout is a lease that holds a number of requests until it is
+// released, expires or the bucket resets, so concurrent callers are spread
+// over the accounts instead of all getting the same one.
+//
+//	POST   /api/v1/broker/leases        acquire a lease
+//	DELETE /api/v1/broker/leases/{id}   release a lease
+type Broker struct {
+	quotas QuotaSource
+	cfg    *config.Broker
+
+	leases map[string]*lease
+	// tokenSources caches GitHub App installation tokens, keyed by user key
+	tokenSources map[string]oauth2.TokenSource
+
+	// Prometheus metrics
+	leasesTotal *prometheus.CounterVec
+	unavailable *prometheus.CounterVec
+
+	mux *http.ServeMux
+	mu  sync.Mutex
+}
+
+// lease holds requests of an account's bucket
+type lease struct {
+	id       string
+	userKey  string
+	resource string
+	cost     int
+	// reset, used and taken identify the bucket window the lease was taken in
+	reset   time.Time
+	used    int
+	taken   time.Time
+	expires time.Time
+}
+
+// acquireRequest is the body of a lease request. All fields are optional.
+type acquireRequest struct {
+	Resource     string `json:"resource"`
+	Cost         int    `json:"cost"`
+	Host         string `json:"host"`
+	IncludeToken bool   `json:"include_token"`
+}
+
+// leaseResponse describes an acquired lease
+type leaseResponse struct {
+	LeaseID   string    `json:"lease_id"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Resource  string    `json:"resource"`
+	Cost      int       `json:"cost"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// New creates a broker for the accounts in quotas. A nil cfg disables the API
+// until a configuration with a broker section is loaded.
+func New(cfg *config.Broker, quotas QuotaSource) *Broker {
+	b := &Broker{
+		quotas:       quotas,
+		cfg:          cfg,
+		leases:       make(map[string]*lease),
+		tokenSources: make(map[string]oauth2.TokenSource),
+	}
+
+	labels := []string{"user", "host", "resource"}
+
+	b.leasesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_broker_leases_total",
+			Help: "Total number of leases handed out by the token broker",
+		},
+		labels,
+	)
+
+	b.unavailable = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_broker_unavailable_total",
+			Help: "Total number of lease requests no account had enough quota for",
+		},
+		[]string{"resource"},
+	)
+
+	b.mux = http.NewServeMux()
+	b.mux.HandleFunc("POST "+PathPrefix+"leases", b.acquire)
+	b.mux.HandleFunc("DELETE "+PathPrefix+"leases/{id}", b.release)
+
+	return b
+}
+
+// Reload replaces the broker settings. Leases are kept, cached tokens are
+// dropped as credentials may have changed.
+func (b *Broker) Reload(cfg *config.Broker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+	b.tokenSources = make(map[string]oauth2.TokenSource)
+}
+
+// ServeHTTP implements http.Handler
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	cfg := b.cfg
+	b.mu.Unlock()
+
+	if cfg == nil {
+		writeError(w, http.StatusNotFound, "token broker is not configured")
+		return
+	}
+
+	if !auth.Authorized(r, cfg.APITokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid api token")
+		return
+	}
+
+	b.mux.ServeHTTP(w, r)
+}
+
+// acquire leases the account with the most remaining quota
+func (b *Broker) acquire(w http.ResponseWriter, r *http.Request) {
+	var req acquireRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+	}
+	if req.Resource == "" {
+		req.Resource = "core"
+	}
+	if req.Cost < 0 {
+		writeError(w, http.StatusBadRequest, "cost must not be negative")
+		return
+	}
+
+	l, quota, available := b.lease(w, &req)
+	if l == nil {
+		return
+	}
+
+	var token string
+	if req.IncludeToken {
+		var err error
+		if token, err = b.token(quota.User); err != nil {
+			// The caller can't use the requests without the token
+			b.mu.Lock()
+			delete(b.leases, l.id)
+			b.mu.Unlock()
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to get token for %s: %v", quota.User.Name, err))
+			return
+		}
+	}
+	b.leasesTotal.WithLabelValues(quota.User.Name, quota.User.Host(), req.Resource).Inc()
+
+	writeJSON(w, http.StatusCreated, leaseResponse{
+		LeaseID:   l.id,
+		User:      quota.User.Name,
+		Host:      quota.User.Host(),
+		Resource:  req.Resource,
+		Cost:      req.Cost,
+		Remaining: available - req.Cost,
+		Reset:     quota.Reset,
+		ExpiresAt: l.expires,
+		Token:     token,
+	})
+}
+
+// lease picks an account and records a lease of it, returning the account's
+// quota and the requests it has left. When there's none to be had, it writes
+// the error response and returns a nil lease.
+func (b *Broker) lease(w http.ResponseWriter, req *acquireRequest) (*lease, collector.Quota, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The broker may have been disabled by a reload in the meantime
+	if b.cfg == nil {
+		writeError(w, http.StatusNotFound, "token broker is not configured")
+		return nil, collector.Quota{}, 0
+	}
+	if req.IncludeToken && !b.cfg.RevealTokens {
+		writeError(w, http.StatusForbidden, "token disclosure is disabled")
+		return nil, collector.Quota{}, 0
+	}
+	if req.Cost == 0 {
+		req.Cost = b.cfg.LeaseCost
+	}
+
+	now := time.Now()
+	b.expireLeases(now)
+
+	quota, available, ok := b.pick(b.quotas.Quotas(req.Resource), req.Host, req.Cost, now)
+	if !ok {
+		b.unavailable.WithLabelValues(req.Resource).Inc()
+		if !quota.Reset.IsZero() && quota.Reset.After(now) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(quota.Reset.Sub(now).Seconds())+1))
+		}
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("no account has %d %s requests left", req.Cost, req.Resource))
+		return nil, collector.Quota{}, 0
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to create lease: %v", err))
+		return nil, collector.Quota{}, 0
+	}
+
+	l := &lease{
+		id:       id,
+		userKey:  quota.User.Key(),
+		resource: req.Resource,
+		cost:     req.Cost,
+		reset:    quota.Reset,
+		used:     quota.Used,
+		taken:    now,
+		expires:  now.Add(time.Duration(b.cfg.LeaseTTL) * time.Second),
+	}
+	b.leases[id] = l
+
+	return l, quota, available
+}
+
+// release gives the requests held by a lease back
+func (b *Broker) release(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := r.PathValue("id")
+	if _, ok := b.leases[id]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown lease %q", id))
+		return
+	}
+	delete(b.leases, id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pick returns the account with the most requests left after subtracting
+// active leases, and how many that is. When no account has cost requests
+// left, it returns the account whose bucket resets first instead.
+func (b *Broker) pick(quotas []collector.Quota, host string, cost int, now time.Time) (collector.Quota, int, bool) {
+	var (
+		best      collector.Quota
+		available = -1
+		earliest  collector.Quota
+	)
+	for _, q := range quotas {
+		if host != "" && q.User.Host() != host {
+			continue
+		}
+		if earliest.Reset.IsZero() || q.Reset.Before(earliest.Reset) {
+			earliest = q
+		}
+
+		left := q.RemainingAt(now) - b.held(q, now)
+
+		if left > available {
+			best, available = q, left
+		}
+	}
+
+	if available < cost {
+		return earliest, 0, false
+	}
+
+	return best, available, true
+}
+
+// held returns the requests leased from a bucket in the window it's in at now:
+// the window ending at its reset or, once that has passed, the one after it.
+// Leases taken before the reset moved count as long as the window didn't end
+// in between.
+func (b *Broker) held(q collector.Quota, now time.Time) int {
+	ended := q.Ended(now)
+	total := 0
+	for _, l := range b.leases {
+		if l.userKey != q.User.Key() || l.resource != q.Resource {
+			continue
+		}
+
+		afterReset := l.taken.After(l.reset)
+		switch {
+		case l.reset.Equal(q.Reset):
+			if afterReset != ended {
+				continue
+			}
+		case ended || afterReset || !q.SameWindow(collector.Quota{Used: l.used, Reset: l.reset}):
+			continue
+		}
+		total += l.cost
+	}
+	return total
+}
+
+// expireLeases drops leases past their TTL
+func (b *Broker) expireLeases(now time.Time) {
+	for id, l := range b.leases {
+		if now.After(l.expires) {
+			delete(b.leases, id)
+		}
+	}
+}
+
+// token returns the GitHub token of an account, minting an installation
+// token for GitHub Apps. Minting is a network call, so it's made without
+// holding the lock to keep other callers from waiting behind it.
+func (b *Broker) token(user config.User) (string, error) {
+	if !user.IsApp() {
+		return user.Token, nil
+	}
+
+	b.mu.Lock()
+	ts, ok := b.tokenSources[user.Key()]
+	if !ok {
+		var err error
+		if ts, err = auth.TokenSource(user); err != nil {
+			b.mu.Unlock()
+			return "", err
+		}
+		b.tokenSources[user.Key()] = ts
+	}
+	b.mu.Unlock()
+
+	token, err := ts.Token()
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+func newLeaseID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// Describe implements prometheus.Collector
+func (b *Broker) Describe(ch chan<- *prometheus.Desc) {
+	b.leasesTotal.Describe(ch)
+	b.unavailable.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (b *Broker) Collect(ch chan<- prometheus.Metric) {
+	b.leasesTotal.Collect(ch)
+	b.unavailable.Collect(ch)
+}
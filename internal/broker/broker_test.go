@@ -0,0 +1,257 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+type staticQuotas []collector.Quota
+
+func (s staticQuotas) Quotas(resource string) []collector.Quota {
+	var quotas []collector.Quota
+	for _, q := range s {
+		if q.Resource == resource {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas
+}
+
+func newTestBroker(revealTokens bool) *Broker {
+	reset := time.Now().Add(time.Hour)
+
+	return New(&config.Broker{
+		APITokens:    []string{"secret"},
+		RevealTokens: revealTokens,
+		LeaseTTL:     300,
+		LeaseCost:    100,
+	}, staticQuotas{
+		{User: config.User{Name: "bot-a", Token: "token-a"}, Resource: "core", Limit: 5000, Remaining: 4000, Reset: reset},
+		{User: config.User{Name: "bot-b", Token: "token-b"}, Resource: "core", Limit: 5000, Remaining: 3500, Reset: reset},
+	})
+}
+
+func acquire(t *testing.T, b *Broker, body string) (*httptest.ResponseRecorder, leaseResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, PathPrefix+"leases", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, req)
+
+	var resp leaseResponse
+	if rec.Code == http.StatusCreated {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+
+	return rec, resp
+}
+
+func TestBroker_Unauthorized(t *testing.T) {
+	b := newTestBroker(false)
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, PathPrefix+"leases", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for %q, got %d", http.StatusUnauthorized, header, rec.Code)
+		}
+	}
+}
+
+func TestBroker_SpreadsLeases(t *testing.T) {
+	b := newTestBroker(false)
+
+	rec, first := acquire(t, b, `{"cost": 1000}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if first.User != "bot-a" || first.Remaining != 3000 {
+		t.Errorf("Expected bot-a with 3000 left, got %s with %d", first.User, first.Remaining)
+	}
+	if first.Token != "" {
+		t.Error("Expected no token without include_token")
+	}
+
+	// bot-a has 3000 left after the lease, bot-b still has 3500
+	_, second := acquire(t, b, `{"cost": 1000}`)
+	if second.User != "bot-b" {
+		t.Errorf("Expected second lease for bot-b, got %s", second.User)
+	}
+
+	// Releasing the first lease makes bot-a the best choice again
+	req := httptest.NewRequest(http.MethodDelete, PathPrefix+"leases/"+first.LeaseID, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d on release, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	_, third := acquire(t, b, `{"cost": 1000}`)
+	if third.User != "bot-a" {
+		t.Errorf("Expected bot-a after release, got %s", third.User)
+	}
+}
+
+// movingQuotas serves a bucket whose reset moves on every call, like GitHub
+// does for buckets nothing was used from
+type movingQuotas struct {
+	quota collector.Quota
+	polls int
+}
+
+func (m *movingQuotas) Quotas(resource string) []collector.Quota {
+	m.polls++
+	q := m.quota
+	q.Reset = q.Reset.Add(time.Duration(m.polls) * time.Second)
+	q.UpdatedAt = time.Now()
+	return []collector.Quota{q}
+}
+
+func TestBroker_HoldsLeasesOfIdleBuckets(t *testing.T) {
+	idle := &movingQuotas{quota: collector.Quota{
+		User: config.User{Name: "bot-a", Token: "token-a"}, Resource: "core",
+		Limit: 5000, Remaining: 5000, Reset: time.Now().Add(time.Hour),
+	}}
+	b := New(&config.Broker{APITokens: []string{"secret"}, LeaseTTL: 300, LeaseCost: 100}, idle)
+
+	_, first := acquire(t, b, `{"cost": 3000}`)
+	if first.Remaining != 2000 {
+		t.Fatalf("Expected 2000 left after the first lease, got %d", first.Remaining)
+	}
+
+	// The moved reset is still the window the first lease was taken in
+	rec, _ := acquire(t, b, `{"cost": 3000}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while the first lease holds the bucket, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// Once requests were used, a moved reset is a new window only after the
+	// old one has passed
+	idle.quota.Used, idle.quota.Remaining = 100, 4900
+	_, second := acquire(t, b, `{"cost": 1000}`)
+	if second.Remaining != 900 {
+		t.Errorf("Expected the first lease to still count, got %d left", second.Remaining)
+	}
+}
+
+func TestBroker_Exhausted(t *testing.T) {
+	b := newTestBroker(false)
+
+	rec, _ := acquire(t, b, `{"cost": 4001}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	rec, _ = acquire(t, b, `{"resource": "search"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d for unknown bucket, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestBroker_TokenDisclosure(t *testing.T) {
+	rec, _ := acquire(t, newTestBroker(false), `{"include_token": true}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec, resp := acquire(t, newTestBroker(true), `{"include_token": true}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if resp.Token != "token-a" {
+		t.Errorf("Expected token-a, got %q", resp.Token)
+	}
+}
+
+// blockingTokenSource mints a token once release is closed
+type blockingTokenSource struct {
+	release chan struct{}
+	err     error
+}
+
+func (s blockingTokenSource) Token() (*oauth2.Token, error) {
+	<-s.release
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &oauth2.Token{AccessToken: "installation-token"}, nil
+}
+
+func TestBroker_MintsTokensWithoutLock(t *testing.T) {
+	app := config.User{Name: "app", AppID: 1, InstallationID: 2, PrivateKeyPath: "app.pem"}
+	b := New(&config.Broker{APITokens: []string{"secret"}, RevealTokens: true, LeaseTTL: 300, LeaseCost: 100}, staticQuotas{
+		{User: app, Resource: "core", Limit: 15000, Remaining: 15000, Reset: time.Now().Add(time.Hour)},
+	})
+	src := blockingTokenSource{release: make(chan struct{})}
+	b.tokenSources[app.Key()] = src
+
+	done := make(chan leaseResponse)
+	go func() {
+		_, resp := acquire(t, b, `{"include_token": true}`)
+		done <- resp
+	}()
+
+	// Other callers aren't held up while the token is minted
+	acquired := make(chan int)
+	go func() {
+		rec, _ := acquire(t, b, `{}`)
+		acquired <- rec.Code
+	}()
+	select {
+	case code := <-acquired:
+		if code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a lease while another caller's token is minted")
+	}
+
+	close(src.release)
+	if resp := <-done; resp.Token != "installation-token" {
+		t.Errorf("Expected the installation token, got %q", resp.Token)
+	}
+
+	// A failed mint gives the lease back
+	failing := blockingTokenSource{release: make(chan struct{}), err: errors.New("unavailable")}
+	close(failing.release)
+	b.tokenSources[app.Key()] = failing
+	rec, _ := acquire(t, b, `{"include_token": true}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+	if n := len(b.leases); n != 2 {
+		t.Errorf("Expected the failed lease to be released, got %d leases", n)
+	}
+}
+
+func TestBroker_Disabled(t *testing.T) {
+	b := newTestBroker(false)
+	b.Reload(nil)
+
+	rec, _ := acquire(t, b, "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
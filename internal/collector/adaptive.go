@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func newPollIntervalMetric(custom []string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_poll_interval_seconds",
+			Help: "Current interval between rate limit polls for the user",
+		},
+		metricLabels(custom),
+	)
+}
+
+// adaptInterval returns the poll interval for a user after a fetch, based on
+// the state of its buckets. Without adaptive polling it's always base.
+//
+//   - no exported bucket consumed anything since the previous polls: the
+//     interval doubles, starting from base. Buckets nothing was used from in
+//     their window count as idle, even before they have a rate.
+//   - a bucket's remaining share dropped to a threshold: the interval is at
+//     most the threshold's
+//   - a bucket is projected to run out within the exhaustion horizon: the
+//     interval is the minimum
+//
+// Buckets fill up again on reset, which relaxes the interval back to base.
+// The result stays within the configured bounds.
+func (c *Collector) adaptInterval(user config.User, base, current time.Duration, now time.Time) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	a := c.adaptive
+	if a == nil {
+		return base
+	}
+	minInterval := time.Duration(a.MinInterval) * time.Second
+	maxInterval := time.Duration(a.MaxInterval) * time.Second
+	horizon := float64(a.ExhaustionHorizon)
+
+	idle, seen := true, false
+	interval := base
+
+	for resource, q := range c.quotas[user.Key()] {
+		// Deselected buckets keep their state until it goes stale
+		if !user.ExportsResource(resource) {
+			continue
+		}
+		seen = true
+
+		perSecond, ok := 0.0, false
+		if h := c.burnRate.history[user.Key()][resource]; h != nil {
+			perSecond, ok = h.rate()
+		}
+		if q.Used > 0 && (!ok || perSecond > 0) {
+			idle = false
+		}
+
+		// The bucket is full again, whatever the last poll saw
+		if q.Limit <= 0 || q.Ended(now) {
+			continue
+		}
+
+		share := float64(q.Remaining) / float64(q.Limit)
+		for _, t := range a.Thresholds {
+			if share <= t.Remaining {
+				interval = min(interval, time.Duration(t.Interval)*time.Second)
+			}
+		}
+
+		r := q.rate()
+		if ok && perSecond > 0 && secondsUntilExhaustion(r, perSecond, now) < horizon {
+			interval = minInterval
+		}
+	}
+
+	if seen && idle && interval == base {
+		interval = max(current, base) * 2
+	}
+
+	return min(max(interval, minInterval), maxInterval)
+}
@@ -0,0 +1,159 @@
+package collector
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// burnRateWindow is how far back samples are kept to compute the consumption rate
+	burnRateWindow = 15 * time.Minute
+
+	// maxBurnRateSamples bounds the history kept per user and resource
+	maxBurnRateSamples = 120
+)
+
+// usageSample is the used count of a bucket at a point in time
+type usageSample struct {
+	at   time.Time
+	used int
+}
+
+// usageHistory holds recent samples of a bucket within its current reset window
+type usageHistory struct {
+	// reset is the reset timestamp of the latest sample
+	reset   int64
+	samples []usageSample
+}
+
+// add records a sample, starting over when the bucket has reset
+func (h *usageHistory) add(r rate, now time.Time) {
+	if n := len(h.samples); n > 0 && windowEnded(rate{Used: h.samples[n-1].used, Reset: h.reset}, r, now) {
+		h.samples = h.samples[:0]
+	}
+	h.reset = r.Reset
+
+	h.samples = append(h.samples, usageSample{at: now, used: r.Used})
+
+	cutoff := now.Add(-burnRateWindow)
+	drop := 0
+	for drop < len(h.samples)-2 && (h.samples[drop].at.Before(cutoff) || len(h.samples)-drop > maxBurnRateSamples) {
+		drop++
+	}
+	h.samples = h.samples[drop:]
+}
+
+// rate returns the consumption in requests per second over the history
+func (h *usageHistory) rate() (float64, bool) {
+	if len(h.samples) < 2 {
+		return 0, false
+	}
+
+	first, last := h.samples[0], h.samples[len(h.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	return float64(last.used-first.used) / elapsed, true
+}
+
+// burnRateMetrics tracks how fast buckets are consumed and when they'll run out
+type burnRateMetrics struct {
+	consumptionRate *prometheus.GaugeVec
+	untilExhaustion *prometheus.GaugeVec
+
+	// history is keyed by user key, then resource name
+	history map[string]map[string]*usageHistory
+}
+
+func newBurnRateMetrics(custom []string) *burnRateMetrics {
+	labels := metricLabels(custom, "resource")
+
+	return &burnRateMetrics{
+		consumptionRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_consumption_rate",
+				Help: "Requests per second consumed from the bucket within its current reset window",
+			},
+			labels,
+		),
+		untilExhaustion: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_seconds_until_exhaustion",
+				Help: "Projected seconds until the bucket is exhausted at the current consumption rate, +Inf if it resets first",
+			},
+			labels,
+		),
+		history: make(map[string]map[string]*usageHistory),
+	}
+}
+
+func (m *burnRateMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.consumptionRate.Describe(ch)
+	m.untilExhaustion.Describe(ch)
+}
+
+func (m *burnRateMetrics) collect(ch chan<- prometheus.Metric) {
+	m.consumptionRate.Collect(ch)
+	m.untilExhaustion.Collect(ch)
+}
+
+func (m *burnRateMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.consumptionRate.DeletePartialMatch(labels)
+	m.untilExhaustion.DeletePartialMatch(labels)
+}
+
+// forget drops the history of a user
+func (m *burnRateMetrics) forget(key string) {
+	delete(m.history, key)
+}
+
+// observe records a bucket sample and updates the projections
+func (m *burnRateMetrics) observe(key string, labels []string, resource string, r rate, now time.Time) {
+	resources, ok := m.history[key]
+	if !ok {
+		resources = make(map[string]*usageHistory)
+		m.history[key] = resources
+	}
+	h, ok := resources[resource]
+	if !ok {
+		h = &usageHistory{}
+		resources[resource] = h
+	}
+
+	h.add(r, now)
+
+	values := withResource(labels, resource)
+
+	// Right after a reset there's not enough history for a projection
+	perSecond, ok := h.rate()
+	if !ok {
+		m.consumptionRate.DeleteLabelValues(values...)
+		m.untilExhaustion.DeleteLabelValues(values...)
+		return
+	}
+
+	m.consumptionRate.WithLabelValues(values...).Set(perSecond)
+	m.untilExhaustion.WithLabelValues(values...).Set(secondsUntilExhaustion(r, perSecond, now))
+}
+
+// secondsUntilExhaustion projects when the bucket runs out at the given rate.
+// Buckets that reset before running out never get exhausted and report +Inf.
+func secondsUntilExhaustion(r rate, perSecond float64, now time.Time) float64 {
+	if r.Remaining <= 0 {
+		return 0
+	}
+	if perSecond <= 0 {
+		return math.Inf(1)
+	}
+
+	seconds := float64(r.Remaining) / perSecond
+	if untilReset := float64(r.Reset - now.Unix()); seconds >= untilReset {
+		return math.Inf(1)
+	}
+
+	return seconds
+}
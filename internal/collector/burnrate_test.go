@@ -0,0 +1,110 @@
+package collector
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUsageHistory_Rate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	reset := start.Add(time.Hour).Unix()
+
+	var h usageHistory
+	h.add(rate{Limit: 5000, Remaining: 4900, Used: 100, Reset: reset}, start)
+
+	if _, ok := h.rate(); ok {
+		t.Error("Expected no rate from a single sample")
+	}
+
+	h.add(rate{Limit: 5000, Remaining: 4780, Used: 220, Reset: reset}, start.Add(time.Minute))
+	h.add(rate{Limit: 5000, Remaining: 4660, Used: 340, Reset: reset}, start.Add(2*time.Minute))
+
+	perSecond, ok := h.rate()
+	if !ok {
+		t.Fatal("Expected a rate from three samples")
+	}
+	if perSecond != 2 {
+		t.Errorf("Expected 2 requests/second, got %v", perSecond)
+	}
+
+	// A new reset window starts over
+	h.add(rate{Limit: 5000, Remaining: 5000, Used: 0, Reset: reset + 3600}, start.Add(61*time.Minute))
+	if _, ok := h.rate(); ok {
+		t.Error("Expected no rate right after a reset")
+	}
+}
+
+func TestUsageHistory_Idle(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	// GitHub reports the reset of an unused bucket as an hour from now
+	var h usageHistory
+	for i := range 3 {
+		now := start.Add(time.Duration(i) * time.Minute)
+		h.add(rate{Limit: 5000, Remaining: 5000, Reset: now.Add(time.Hour).Unix()}, now)
+	}
+
+	perSecond, ok := h.rate()
+	if !ok || perSecond != 0 {
+		t.Errorf("Expected a rate of 0 for an idle bucket, got %v (ok: %v)", perSecond, ok)
+	}
+}
+
+func TestUsageHistory_Window(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	reset := start.Add(time.Hour).Unix()
+
+	var h usageHistory
+	for i := 0; i <= 30; i++ {
+		h.add(rate{Used: i * 60, Reset: reset}, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	if first := h.samples[0].at; start.Add(30*time.Minute).Sub(first) > burnRateWindow {
+		t.Errorf("Expected samples older than %s to be dropped, oldest is %s", burnRateWindow, first)
+	}
+}
+
+func TestSecondsUntilExhaustion(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		r         rate
+		perSecond float64
+		expected  float64
+	}{
+		{
+			name:      "runs out before reset",
+			r:         rate{Remaining: 600, Reset: now.Add(time.Hour).Unix()},
+			perSecond: 1,
+			expected:  600,
+		},
+		{
+			name:      "resets before running out",
+			r:         rate{Remaining: 600, Reset: now.Add(5 * time.Minute).Unix()},
+			perSecond: 1,
+			expected:  math.Inf(1),
+		},
+		{
+			name:      "idle",
+			r:         rate{Remaining: 600, Reset: now.Add(time.Hour).Unix()},
+			perSecond: 0,
+			expected:  math.Inf(1),
+		},
+		{
+			name:      "exhausted",
+			r:         rate{Remaining: 0, Reset: now.Add(time.Hour).Unix()},
+			perSecond: 1,
+			expected:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secondsUntilExhaustion(tt.r, tt.perSecond, now); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package collector
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Circuit states used in the state label of github_rate_limit_circuit_state
+const (
+	// circuitClosed polls the user normally
+	circuitClosed = "closed"
+	// circuitOpen skips the user until its backoff has passed
+	circuitOpen = "open"
+	// circuitDisabled stops polling the user until the config is reloaded
+	circuitDisabled = "disabled"
+)
+
+var circuitStates = []string{circuitClosed, circuitOpen, circuitDisabled}
+
+const (
+	// minBackoff is the delay after the first failed fetch, doubled after each
+	// further one
+	minBackoff = 30 * time.Second
+
+	// maxBackoff bounds the delay between fetches of a failing user
+	maxBackoff = 30 * time.Minute
+)
+
+// circuit tracks the failed fetches of a user
+type circuit struct {
+	failures int
+	retryAt  time.Time
+	disabled bool
+}
+
+// circuitMetrics exports the circuit state of each user
+type circuitMetrics struct {
+	state *prometheus.GaugeVec
+}
+
+func newCircuitMetrics(custom []string) *circuitMetrics {
+	return &circuitMetrics{
+		state: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_circuit_state",
+				Help: "Circuit breaker state of the user's rate limit fetches, 1 for the current state",
+			},
+			metricLabels(custom, "state"),
+		),
+	}
+}
+
+func (m *circuitMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.state.Describe(ch)
+}
+
+func (m *circuitMetrics) collect(ch chan<- prometheus.Metric) {
+	m.state.Collect(ch)
+}
+
+func (m *circuitMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.state.DeletePartialMatch(labels)
+}
+
+func (m *circuitMetrics) set(labels []string, current string) {
+	for _, state := range circuitStates {
+		v := 0.0
+		if state == current {
+			v = 1
+		}
+		m.state.WithLabelValues(append(labels, state)...).Set(v)
+	}
+}
+
+// backoff returns the delay before the next fetch after a number of
+// consecutive failures. Half of it is random so users failing together, e.g.
+// during a GHES outage, don't all retry at once.
+func backoff(failures int) time.Duration {
+	d := maxBackoff
+	if shift := failures - 1; shift < 16 {
+		d = min(minBackoff<<shift, maxBackoff)
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// isDisabled reports whether a user's token was rejected. The caller
+// must hold c.mu.
+func (c *Collector) isDisabled(user config.User) bool {
+	cb, ok := c.circuits[user.Key()]
+	return ok && cb.disabled
+}
+
+// shouldFetch tells whether a user's circuit lets a fetch through
+func (c *Collector) shouldFetch(user config.User, now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cb, ok := c.circuits[user.Key()]
+	if !ok {
+		return true
+	}
+
+	return !cb.disabled && !now.Before(cb.retryAt)
+}
+
+// fetchSucceeded closes the circuit of a user
+func (c *Collector) fetchSucceeded(user config.User, labels []string) {
+	if cb, ok := c.circuits[user.Key()]; ok {
+		log.Printf("Rate limits for user %s on %s are reachable again after %d failed fetches", user.Name, user.Host(), cb.failures)
+		delete(c.circuits, user.Key())
+	}
+
+	c.circuitMetrics.set(labels, circuitClosed)
+}
+
+// fetchFailed opens the circuit of a user. A rejected token won't start
+// working by itself, so 401s stop polling until the config is reloaded and
+// drop the user's quotas, keeping the broker from handing the token out;
+// everything else, e.g. server errors and timeouts, is retried with backoff.
+// retryAfter is the least delay GitHub asked for, if any.
+func (c *Collector) fetchFailed(user config.User, labels []string, reason string, retryAfter time.Duration, now time.Time) {
+	cb, ok := c.circuits[user.Key()]
+	if !ok {
+		cb = &circuit{}
+		c.circuits[user.Key()] = cb
+	}
+	cb.failures++
+
+	if reason == reasonUnauthorized {
+		cb.disabled = true
+		delete(c.quotas, user.Key())
+		log.Printf("Token for user %s on %s was rejected, not polling it until the config is reloaded", user.Name, user.Host())
+		c.circuitMetrics.set(labels, circuitDisabled)
+		return
+	}
+
+	delay := max(backoff(cb.failures), retryAfter)
+	cb.retryAt = now.Add(delay)
+	log.Printf("Retrying user %s on %s in %s after %d failed fetches", user.Name, user.Host(), delay.Round(time.Second), cb.failures)
+	c.circuitMetrics.set(labels, circuitOpen)
+}
@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/google/go-github/v57/github"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// ClientCache keeps the GitHub clients and token logins of accounts across
+// collectors, so short-lived ones, e.g. one per probe, reuse installation
+// tokens and look each login up once
+type ClientCache struct {
+	mu      sync.Mutex
+	clients map[string]cachedClient
+	logins  map[string]string
+}
+
+// cachedClient is a client and the account it was created for
+type cachedClient struct {
+	user   config.User
+	client *github.Client
+}
+
+// NewClientCache creates an empty client cache
+func NewClientCache() *ClientCache {
+	return &ClientCache{
+		clients: make(map[string]cachedClient),
+		logins:  make(map[string]string),
+	}
+}
+
+// client returns the cached client of a user, creating one if the user is new
+// or its credentials or endpoints changed
+func (cc *ClientCache) client(user config.User) (*github.Client, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cached, ok := cc.clients[user.Key()]; ok && sameAccount(cached.user, user) {
+		return cached.client, nil
+	}
+
+	client, err := newUserClient(user)
+	if err != nil {
+		return nil, err
+	}
+	cc.clients[user.Key()] = cachedClient{user: user, client: client}
+	delete(cc.logins, user.Key())
+	return client, nil
+}
+
+// login returns the cached login of a user key
+func (cc *ClientCache) login(key string) (string, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	login, ok := cc.logins[key]
+	return login, ok
+}
+
+// setLogin caches the login of a user key
+func (cc *ClientCache) setLogin(key, login string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.logins[key] = login
+}
+
+// Retain drops the clients and logins of accounts that aren't in users
+func (cc *ClientCache) Retain(users []config.User) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for key, cached := range cc.clients {
+		if !slices.ContainsFunc(users, func(u config.User) bool { return sameAccount(u, cached.user) }) {
+			delete(cc.clients, key)
+			delete(cc.logins, key)
+		}
+	}
+}
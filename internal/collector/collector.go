@@ -2,7 +2,12 @@ package collector
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,321 +15,746 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
 
+	"github.com/l13t/github_rate_limit_exporter/internal/auth"
 	"github.com/l13t/github_rate_limit_exporter/internal/config"
 )
 
+// resourceMetrics holds the gauges exported for a single rate limit bucket
+type resourceMetrics struct {
+	limit     *prometheus.GaugeVec
+	remaining *prometheus.GaugeVec
+	used      *prometheus.GaugeVec
+	reset     *prometheus.GaugeVec
+}
+
 // Collector collects GitHub API rate limit metrics
 type Collector struct {
 	users   []config.User
 	clients map[string]*github.Client
-
-	// Prometheus metrics
-	coreLimit     *prometheus.GaugeVec
-	coreRemaining *prometheus.GaugeVec
-	coreUsed      *prometheus.GaugeVec
-	coreReset     *prometheus.GaugeVec
-
-	searchLimit     *prometheus.GaugeVec
-	searchRemaining *prometheus.GaugeVec
-	searchUsed      *prometheus.GaugeVec
-	searchReset     *prometheus.GaugeVec
-
-	graphqlLimit     *prometheus.GaugeVec
-	graphqlRemaining *prometheus.GaugeVec
-	graphqlUsed      *prometheus.GaugeVec
-	graphqlReset     *prometheus.GaugeVec
-
-	integrationManifestLimit     *prometheus.GaugeVec
-	integrationManifestRemaining *prometheus.GaugeVec
-	integrationManifestUsed      *prometheus.GaugeVec
-	integrationManifestReset     *prometheus.GaugeVec
+	// labelNames are the names of the users' custom labels, added to every
+	// metric after user and host
+	labelNames []string
+	// workers bounds how many users are fetched at the same time
+	workers int
+	// adaptive adjusts poll intervals to the remaining quota, nil if disabled
+	adaptive *config.AdaptivePolling
+	// Current poll interval per user, set by the scheduler
+	pollInterval *prometheus.GaugeVec
+
+	// Legacy per-bucket metrics keyed by resource name, nil unless enabled
+	rateMetrics map[string]*resourceMetrics
+	// Metrics with a resource label, nil unless enabled
+	labelledMetrics *resourceMetrics
+	// Fetch health metrics
+	health *healthMetrics
+	// Token metadata metrics
+	tokens *tokenMetrics
+	// logins caches the login behind each user key's token
+	logins map[string]string
+	// cache shares clients and logins with other collectors, nil if unused
+	cache *ClientCache
+	// Consumption rate and exhaustion projections
+	burnRate *burnRateMetrics
+	// Consumed request and reset counters
+	consumption *consumptionMetrics
+	// Secondary rate limit hits
+	secondary *secondaryLimitMetrics
+
+	// groups are exported in aggregate next to their members
+	groups       []config.Group
+	groupMetrics *groupMetrics
+
+	// circuits tracks failing users by user key, users fetched fine have none
+	circuits       map[string]*circuit
+	circuitMetrics *circuitMetrics
+
+	// quotas holds the last known bucket states by user key, then resource name
+	quotas map[string]map[string]Quota
+
+	// scrape is set when rate limits are fetched on scrape instead of polled
+	scrape *scrapeCache
+
+	// staleAfter is how long rate limit series survive without a successful
+	// fetch or an observed update, zero keeps them forever
+	staleAfter time.Duration
+	// lastUpdate holds the time of the last successful fetch or observed
+	// update per user key
+	lastUpdate map[string]time.Time
+
+	// onUpdate are called after rate limits were fetched
+	onUpdate []func()
 
 	mu sync.RWMutex
 }
 
 // NewCollector creates a new GitHub rate limit collector
-func NewCollector(users []config.User) *Collector {
+func NewCollector(cfg *config.Config) (*Collector, error) {
+	return newCollector(cfg, nil)
+}
+
+// NewCachedCollector creates a collector that takes its clients and logins
+// from cache, for collectors that don't outlive a single fetch
+func NewCachedCollector(cfg *config.Config, cache *ClientCache) (*Collector, error) {
+	return newCollector(cfg, cache)
+}
+
+func newCollector(cfg *config.Config, cache *ClientCache) (*Collector, error) {
+	// All users share the same label names, checked by the config
+	var custom []string
+	if len(cfg.Users) > 0 {
+		custom = cfg.Users[0].LabelNames()
+	}
+
 	c := &Collector{
-		users:   users,
-		clients: make(map[string]*github.Client),
+		users:      cfg.Users,
+		clients:    make(map[string]*github.Client),
+		labelNames: custom,
+		health:     newHealthMetrics(custom),
+		tokens:     newTokenMetrics(custom),
+		logins:     make(map[string]string),
+		cache:      cache,
+		quotas:     make(map[string]map[string]Quota),
+
+		burnRate:    newBurnRateMetrics(custom),
+		consumption: newConsumptionMetrics(custom),
+		secondary:   newSecondaryLimitMetrics(custom),
+
+		groups:       cfg.Groups,
+		groupMetrics: newGroupMetrics(),
+
+		circuits:       make(map[string]*circuit),
+		circuitMetrics: newCircuitMetrics(custom),
+
+		adaptive:     cfg.AdaptivePolling,
+		pollInterval: newPollIntervalMetric(custom),
+
+		staleAfter: time.Duration(cfg.StaleAfter) * time.Second,
+		lastUpdate: make(map[string]time.Time),
+	}
+
+	// Configs not loaded from a file, e.g. for probes, have no worker count
+	c.workers = cfg.PollWorkers
+	if c.workers <= 0 {
+		c.workers = 10
+	}
+
+	if cfg.CollectionMode == config.CollectionModeScrape {
+		c.scrape = &scrapeCache{
+			timeout: time.Duration(cfg.ScrapeTimeout) * time.Second,
+			ttl:     time.Duration(cfg.ScrapeCacheTTL) * time.Second,
+		}
 	}
 
 	// Initialize Prometheus metrics
-	c.coreLimit = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_core_limit",
-			Help: "GitHub API core rate limit",
-		},
-		[]string{"user"},
-	)
+	if cfg.MetricLayout != config.MetricLayoutResource {
+		c.rateMetrics = make(map[string]*resourceMetrics)
+		for _, res := range resources {
+			c.rateMetrics[res.name] = newLegacyResourceMetrics(res, custom)
+		}
+	}
+	if cfg.MetricLayout == config.MetricLayoutResource || cfg.MetricLayout == config.MetricLayoutBoth {
+		c.labelledMetrics = newLabelledResourceMetrics(custom)
+	}
 
-	c.coreRemaining = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_core_remaining",
-			Help: "GitHub API core rate limit remaining",
-		},
-		[]string{"user"},
-	)
+	// Initialize GitHub clients for each user
+	for _, user := range cfg.Users {
+		if err := validateResources(user); err != nil {
+			return nil, err
+		}
+		client, err := c.newClient(user)
+		if err != nil {
+			return nil, err
+		}
+		c.clients[user.Key()] = client
+	}
 
-	c.coreUsed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_core_used",
-			Help: "GitHub API core rate limit used",
-		},
-		[]string{"user"},
-	)
+	return c, nil
+}
 
-	c.coreReset = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_core_reset_timestamp",
-			Help: "GitHub API core rate limit reset timestamp",
-		},
-		[]string{"user"},
-	)
+// metricLabels returns the label names of a metric family: user and host, the
+// custom labels, then the family's own labels
+func metricLabels(custom []string, own ...string) []string {
+	names := make([]string, 0, 2+len(custom)+len(own))
+	names = append(names, "user", "host")
+	names = append(names, custom...)
+	return append(names, own...)
+}
 
-	c.searchLimit = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_search_limit",
-			Help: "GitHub API search rate limit",
-		},
-		[]string{"user"},
-	)
+// userLabels returns the user, host and custom label values of a user, in the
+// order of metricLabels
+func (c *Collector) userLabels(user config.User) []string {
+	values := make([]string, 0, 2+len(c.labelNames))
+	values = append(values, user.Name, user.Host())
+	for _, name := range c.labelNames {
+		values = append(values, user.Labels[name])
+	}
+	return values
+}
 
-	c.searchRemaining = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_search_remaining",
-			Help: "GitHub API search rate limit remaining",
-		},
-		[]string{"user"},
-	)
+// withResource returns a copy of the label values with the resource appended
+func withResource(labels []string, resource string) []string {
+	values := make([]string, 0, len(labels)+1)
+	return append(append(values, labels...), resource)
+}
 
-	c.searchUsed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_search_used",
-			Help: "GitHub API search rate limit used",
-		},
-		[]string{"user"},
-	)
+// newClient returns a GitHub client for a user, from the cache if the
+// collector has one
+func (c *Collector) newClient(user config.User) (*github.Client, error) {
+	if c.cache != nil {
+		return c.cache.client(user)
+	}
+	return newUserClient(user)
+}
 
-	c.searchReset = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_search_reset_timestamp",
-			Help: "GitHub API search rate limit reset timestamp",
-		},
-		[]string{"user"},
-	)
+// newUserClient creates an authenticated GitHub client for a user
+func newUserClient(user config.User) (*github.Client, error) {
+	ts, err := auth.TokenSource(user)
+	if err != nil {
+		return nil, err
+	}
+	tc := oauth2.NewClient(context.Background(), ts)
+	return auth.NewClient(user, tc)
+}
 
-	c.graphqlLimit = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_graphql_limit",
-			Help: "GitHub API GraphQL rate limit",
-		},
-		[]string{"user"},
-	)
+// Reload applies a new configuration without losing the state of unchanged
+// users. New users get a client, removed users lose their client and all their
+// series, and users whose credentials or endpoints changed get a new client
+// under the same labels. Poll intervals and resource selections apply on the
+// next poll, deselected resources lose their series. Users whose custom label
+// values changed lose their series, which come back with the new labels on the
+// next poll. Settings that shape the exported metric families, including the
+// custom label names, or the collection mode can't change at runtime and need
+// a restart.
+func (c *Collector) Reload(cfg *config.Config) error {
+	for _, user := range cfg.Users {
+		if names := user.LabelNames(); !slices.Equal(names, c.labelNames) {
+			return fmt.Errorf("labels [%s] of user %s differ from the running labels [%s], which only change on restart",
+				strings.Join(names, ", "), user.Name, strings.Join(c.labelNames, ", "))
+		}
+	}
 
-	c.graphqlRemaining = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_graphql_remaining",
-			Help: "GitHub API GraphQL rate limit remaining",
-		},
-		[]string{"user"},
-	)
+	c.mu.RLock()
+	current := make(map[string]config.User, len(c.users))
+	for _, user := range c.users {
+		current[user.Key()] = user
+	}
+	c.mu.RUnlock()
 
-	c.graphqlUsed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_graphql_used",
-			Help: "GitHub API GraphQL rate limit used",
-		},
-		[]string{"user"},
-	)
+	// Build all new clients first so a bad entry leaves the collector untouched
+	clients := make(map[string]*github.Client, len(cfg.Users))
+	for _, user := range cfg.Users {
+		if err := validateResources(user); err != nil {
+			return err
+		}
+		if old, ok := current[user.Key()]; ok && sameAccount(old, user) {
+			continue
+		}
+		client, err := c.newClient(user)
+		if err != nil {
+			return err
+		}
+		clients[user.Key()] = client
+	}
 
-	c.graphqlReset = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_graphql_reset_timestamp",
-			Help: "GitHub API GraphQL rate limit reset timestamp",
-		},
-		[]string{"user"},
-	)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.integrationManifestLimit = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_integration_manifest_limit",
-			Help: "GitHub API integration manifest rate limit",
-		},
-		[]string{"user"},
-	)
+	keep := make(map[string]bool, len(cfg.Users))
+	for _, user := range cfg.Users {
+		keep[user.Key()] = true
 
-	c.integrationManifestRemaining = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_integration_manifest_remaining",
-			Help: "GitHub API integration manifest rate limit remaining",
-		},
-		[]string{"user"},
-	)
+		// A reload gives rejected tokens another chance, and new credentials
+		// start without backoff
+		if cb, ok := c.circuits[user.Key()]; ok && (cb.disabled || clients[user.Key()] != nil) {
+			delete(c.circuits, user.Key())
+			c.circuitMetrics.set(c.userLabels(user), circuitClosed)
+		}
 
-	c.integrationManifestUsed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_integration_manifest_used",
-			Help: "GitHub API integration manifest rate limit used",
-		},
-		[]string{"user"},
-	)
+		if client, ok := clients[user.Key()]; ok {
+			if _, existed := current[user.Key()]; existed {
+				log.Printf("Reloaded credentials for user %s on %s", user.Name, user.Host())
+				delete(c.logins, user.Key())
+				// A new token may be a different account with its own buckets
+				delete(c.quotas, user.Key())
+			} else {
+				log.Printf("Added user %s on %s", user.Name, user.Host())
+			}
+			c.clients[user.Key()] = client
+		}
+	}
 
-	c.integrationManifestReset = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_integration_manifest_reset_timestamp",
-			Help: "GitHub API integration manifest rate limit reset timestamp",
-		},
-		[]string{"user"},
-	)
+	for _, user := range cfg.Users {
+		old, ok := current[user.Key()]
+		if !ok {
+			continue
+		}
+		if !maps.Equal(old.Labels, user.Labels) {
+			log.Printf("Labels of user %s on %s changed, dropping its series", user.Name, user.Host())
+			c.deleteSeries(old)
+			continue
+		}
+		for _, res := range resources {
+			if old.ExportsResource(res.name) && !user.ExportsResource(res.name) {
+				c.deleteResourceSeries(user, res.name)
+			}
+		}
+	}
 
-	// Initialize GitHub clients for each user
-	for _, user := range users {
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: user.Token},
-		)
-		tc := oauth2.NewClient(context.Background(), ts)
-		c.clients[user.Name] = github.NewClient(tc)
+	for key, user := range current {
+		if keep[key] {
+			continue
+		}
+		log.Printf("Removed user %s on %s", user.Name, user.Host())
+		c.deleteUser(user)
+	}
+
+	c.users = cfg.Users
+	c.staleAfter = time.Duration(cfg.StaleAfter) * time.Second
+	c.adaptive = cfg.AdaptivePolling
+	c.groups = cfg.Groups
+
+	if c.scrape != nil {
+		c.scrape.mu.Lock()
+		c.scrape.timeout = time.Duration(cfg.ScrapeTimeout) * time.Second
+		c.scrape.ttl = time.Duration(cfg.ScrapeCacheTTL) * time.Second
+		// Serve the new users on the next scrape
+		c.scrape.lastFetch = time.Time{}
+		c.scrape.mu.Unlock()
 	}
 
-	return c
+	return nil
 }
 
-// Describe implements prometheus.Collector
-func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
-	c.coreLimit.Describe(ch)
-	c.coreRemaining.Describe(ch)
-	c.coreUsed.Describe(ch)
-	c.coreReset.Describe(ch)
+// newLegacyResourceMetrics creates one metric family per value for a bucket
+func newLegacyResourceMetrics(res resource, custom []string) *resourceMetrics {
+	labels := metricLabels(custom)
+
+	return &resourceMetrics{
+		limit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_" + res.name + "_limit",
+				Help: "GitHub API " + res.description + " rate limit",
+			},
+			labels,
+		),
+		remaining: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_" + res.name + "_remaining",
+				Help: "GitHub API " + res.description + " rate limit remaining",
+			},
+			labels,
+		),
+		used: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_" + res.name + "_used",
+				Help: "GitHub API " + res.description + " rate limit used",
+			},
+			labels,
+		),
+		reset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_" + res.name + "_reset_timestamp",
+				Help: "GitHub API " + res.description + " rate limit reset timestamp",
+			},
+			labels,
+		),
+	}
+}
+
+// newLabelledResourceMetrics creates metric families shared by all buckets,
+// told apart by a resource label
+func newLabelledResourceMetrics(custom []string) *resourceMetrics {
+	labels := metricLabels(custom, "resource")
+
+	return &resourceMetrics{
+		limit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_limit",
+				Help: "GitHub API rate limit",
+			},
+			labels,
+		),
+		remaining: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_remaining",
+				Help: "GitHub API rate limit remaining",
+			},
+			labels,
+		),
+		used: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_used",
+				Help: "GitHub API rate limit used",
+			},
+			labels,
+		),
+		reset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_reset_timestamp_seconds",
+				Help: "GitHub API rate limit reset timestamp in seconds since epoch",
+			},
+			labels,
+		),
+	}
+}
+
+func (m *resourceMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.limit.Describe(ch)
+	m.remaining.Describe(ch)
+	m.used.Describe(ch)
+	m.reset.Describe(ch)
+}
 
-	c.searchLimit.Describe(ch)
-	c.searchRemaining.Describe(ch)
-	c.searchUsed.Describe(ch)
-	c.searchReset.Describe(ch)
+func (m *resourceMetrics) collect(ch chan<- prometheus.Metric) {
+	m.limit.Collect(ch)
+	m.remaining.Collect(ch)
+	m.used.Collect(ch)
+	m.reset.Collect(ch)
+}
 
-	c.graphqlLimit.Describe(ch)
-	c.graphqlRemaining.Describe(ch)
-	c.graphqlUsed.Describe(ch)
-	c.graphqlReset.Describe(ch)
+func (m *resourceMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.limit.DeletePartialMatch(labels)
+	m.remaining.DeletePartialMatch(labels)
+	m.used.DeletePartialMatch(labels)
+	m.reset.DeletePartialMatch(labels)
+}
 
-	c.integrationManifestLimit.Describe(ch)
-	c.integrationManifestRemaining.Describe(ch)
-	c.integrationManifestUsed.Describe(ch)
-	c.integrationManifestReset.Describe(ch)
+func (m *resourceMetrics) set(labels []string, r rate) {
+	m.limit.WithLabelValues(labels...).Set(float64(r.Limit))
+	m.remaining.WithLabelValues(labels...).Set(float64(r.Remaining))
+	m.used.WithLabelValues(labels...).Set(float64(r.Used))
+	m.reset.WithLabelValues(labels...).Set(float64(r.Reset))
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	if c.rateMetrics != nil {
+		for _, res := range resources {
+			c.rateMetrics[res.name].describe(ch)
+		}
+	}
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.describe(ch)
+	}
+	c.health.describe(ch)
+	c.tokens.describe(ch)
+	c.burnRate.describe(ch)
+	c.consumption.describe(ch)
+	c.secondary.describe(ch)
+	c.circuitMetrics.describe(ch)
+	c.pollInterval.Describe(ch)
+	c.groupMetrics.describe(ch)
 }
 
 // Collect implements prometheus.Collector
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if c.scrape != nil {
+		c.refresh()
+	}
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	c.coreLimit.Collect(ch)
-	c.coreRemaining.Collect(ch)
-	c.coreUsed.Collect(ch)
-	c.coreReset.Collect(ch)
-
-	c.searchLimit.Collect(ch)
-	c.searchRemaining.Collect(ch)
-	c.searchUsed.Collect(ch)
-	c.searchReset.Collect(ch)
-
-	c.graphqlLimit.Collect(ch)
-	c.graphqlRemaining.Collect(ch)
-	c.graphqlUsed.Collect(ch)
-	c.graphqlReset.Collect(ch)
-
-	c.integrationManifestLimit.Collect(ch)
-	c.integrationManifestRemaining.Collect(ch)
-	c.integrationManifestUsed.Collect(ch)
-	c.integrationManifestReset.Collect(ch)
+	if c.rateMetrics != nil {
+		for _, res := range resources {
+			c.rateMetrics[res.name].collect(ch)
+		}
+	}
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.collect(ch)
+	}
+	c.health.collect(ch)
+	c.tokens.collect(ch)
+	c.burnRate.collect(ch)
+	c.consumption.collect(ch)
+	c.secondary.collect(ch)
+	c.circuitMetrics.collect(ch)
+	c.pollInterval.Collect(ch)
+	c.collectGroups(ch, time.Now())
 }
 
-// Update fetches the latest rate limit data from GitHub API
+// Update fetches the latest rate limit data from GitHub API for all users at
+// once, running at most poll_workers fetches at a time
 func (c *Collector) Update(ctx context.Context) {
-	var wg sync.WaitGroup
+	c.mu.RLock()
+	users := c.users
+	c.mu.RUnlock()
 
-	for _, user := range c.users {
+	jobs := make(chan config.User)
+	var wg sync.WaitGroup
+	for range min(c.workers, len(users)) {
 		wg.Add(1)
-		go func(u config.User) {
+		go func() {
 			defer wg.Done()
-			c.updateUserRateLimits(ctx, u)
-		}(user)
+			for user := range jobs {
+				c.updateUserRateLimits(ctx, user)
+			}
+		}()
 	}
 
+	now := time.Now()
+	for _, user := range users {
+		// Failing users are retried with backoff
+		if c.shouldFetch(user, now) {
+			jobs <- user
+		}
+	}
+	close(jobs)
 	wg.Wait()
+
+	c.expireStale(time.Now())
+	c.updated()
+}
+
+// OnUpdate registers a function called after rate limits were fetched: after
+// every Update, and after every fetch while polling. It must be safe for
+// concurrent use.
+func (c *Collector) OnUpdate(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onUpdate = append(c.onUpdate, fn)
+}
+
+// updated calls the functions registered with OnUpdate
+func (c *Collector) updated() {
+	c.mu.RLock()
+	hooks := c.onUpdate
+	c.mu.RUnlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
 }
 
 func (c *Collector) updateUserRateLimits(ctx context.Context, user config.User) {
-	client, ok := c.clients[user.Name]
+	c.mu.RLock()
+	client, ok := c.clients[user.Key()]
+	c.mu.RUnlock()
 	if !ok {
-		log.Printf("No client found for user %s", user.Name)
+		log.Printf("No client found for user %s on %s", user.Name, user.Host())
 		return
 	}
 
-	rateLimits, _, err := client.RateLimit.Get(ctx)
-	if err != nil {
-		log.Printf("Error fetching rate limits for user %s: %v", user.Name, err)
-		return
+	start := time.Now()
+	rateLimits, resp, err := fetchRateLimits(ctx, client)
+	elapsed := time.Since(start)
+
+	var login string
+	if err == nil {
+		login = c.resolveLogin(ctx, client, user)
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Core rate limits
-	if rateLimits.Core != nil {
-		c.coreLimit.WithLabelValues(user.Name).Set(float64(rateLimits.Core.Limit))
-		c.coreRemaining.WithLabelValues(user.Name).Set(float64(rateLimits.Core.Remaining))
-		c.coreUsed.WithLabelValues(user.Name).Set(float64(rateLimits.Core.Limit - rateLimits.Core.Remaining))
-		c.coreReset.WithLabelValues(user.Name).Set(float64(rateLimits.Core.Reset.Unix()))
+	// A reload may have removed the user or changed its account, labels or
+	// resources while the fetch was in flight
+	current, ok := c.currentUser(user.Key())
+	if !ok || !sameAccount(current, user) {
+		return
 	}
+	user = current
+	labels := c.userLabels(user)
+	c.health.fetchDuration.WithLabelValues(labels...).Observe(elapsed.Seconds())
 
-	// Search rate limits
-	if rateLimits.Search != nil {
-		c.searchLimit.WithLabelValues(user.Name).Set(float64(rateLimits.Search.Limit))
-		c.searchRemaining.WithLabelValues(user.Name).Set(float64(rateLimits.Search.Remaining))
-		c.searchUsed.WithLabelValues(user.Name).Set(float64(rateLimits.Search.Limit - rateLimits.Search.Remaining))
-		c.searchReset.WithLabelValues(user.Name).Set(float64(rateLimits.Search.Reset.Unix()))
+	if err != nil {
+		log.Printf("Error fetching rate limits for user %s on %s: %v", user.Name, user.Host(), err)
+		c.health.up.WithLabelValues(labels...).Set(0)
+		reason := classifyError(err)
+		c.health.fetchErrors.WithLabelValues(append(labels, reason)...).Inc()
+
+		var retryAfter time.Duration
+		if resp != nil {
+			if d, ok := SecondaryLimit(resp); ok {
+				c.secondary.observe(labels, d)
+				retryAfter = d
+			}
+		}
+		c.fetchFailed(user, labels, reason, retryAfter, time.Now())
+		return
 	}
 
-	// GraphQL rate limits
-	if rateLimits.GraphQL != nil {
-		c.graphqlLimit.WithLabelValues(user.Name).Set(float64(rateLimits.GraphQL.Limit))
-		c.graphqlRemaining.WithLabelValues(user.Name).Set(float64(rateLimits.GraphQL.Remaining))
-		c.graphqlUsed.WithLabelValues(user.Name).Set(float64(rateLimits.GraphQL.Limit - rateLimits.GraphQL.Remaining))
-		c.graphqlReset.WithLabelValues(user.Name).Set(float64(rateLimits.GraphQL.Reset.Unix()))
-	}
+	now := time.Now()
+	c.fetchSucceeded(user, labels)
+	c.lastUpdate[user.Key()] = now
+	c.health.up.WithLabelValues(labels...).Set(1)
+	c.health.lastSuccess.WithLabelValues(labels...).Set(float64(now.Unix()))
+	c.tokens.set(user, labels, login, resp)
 
-	// Integration Manifest rate limits
-	if rateLimits.IntegrationManifest != nil {
-		c.integrationManifestLimit.WithLabelValues(user.Name).Set(float64(rateLimits.IntegrationManifest.Limit))
-		c.integrationManifestRemaining.WithLabelValues(user.Name).Set(float64(rateLimits.IntegrationManifest.Remaining))
-		c.integrationManifestUsed.WithLabelValues(user.Name).Set(float64(rateLimits.IntegrationManifest.Limit - rateLimits.IntegrationManifest.Remaining))
-		c.integrationManifestReset.WithLabelValues(user.Name).Set(float64(rateLimits.IntegrationManifest.Reset.Unix()))
+	for _, res := range resources {
+		if !user.ExportsResource(res.name) {
+			continue
+		}
+		// Reported or proxied responses may already be ahead of the poll
+		if r, ok := rateLimits[res.name]; ok && c.isNewer(user, res.name, r, now) {
+			c.setRate(user, labels, res.name, r, now)
+		}
 	}
 
-	log.Printf("Updated rate limits for user %s: Core=%d/%d, Search=%d/%d, GraphQL=%d/%d",
-		user.Name,
-		rateLimits.Core.Remaining, rateLimits.Core.Limit,
-		rateLimits.Search.Remaining, rateLimits.Search.Limit,
-		rateLimits.GraphQL.Remaining, rateLimits.GraphQL.Limit,
+	core, search, graphql := rateLimits["core"], rateLimits["search"], rateLimits["graphql"]
+	log.Printf("Updated rate limits for user %s on %s: Core=%d/%d, Search=%d/%d, GraphQL=%d/%d",
+		user.Name, user.Host(),
+		core.Remaining, core.Limit,
+		search.Remaining, search.Limit,
+		graphql.Remaining, graphql.Limit,
 	)
 }
 
-// StartPolling starts a background goroutine that periodically updates rate limits
-func (c *Collector) StartPolling(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// currentUser returns the running configuration of a user key. The caller
+// must hold c.mu.
+func (c *Collector) currentUser(key string) (config.User, bool) {
+	for _, user := range c.users {
+		if user.Key() == key {
+			return user, true
+		}
+	}
+	return config.User{}, false
+}
 
-	// Do an initial update
-	c.Update(ctx)
+// setRate updates everything derived from a bucket's state
+func (c *Collector) setRate(user config.User, labels []string, resource string, r rate, now time.Time) {
+	if m, ok := c.rateMetrics[resource]; ok {
+		m.set(labels, r)
+	}
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.set(withResource(labels, resource), r)
+	}
+	c.burnRate.observe(user.Key(), labels, resource, r, now)
+	c.consumption.observe(user.Key(), labels, resource, r, now)
+	c.setQuota(user, resource, r, now)
+}
+
+// resolveLogin returns the login behind a user's token, looking it up once.
+// Installation tokens can't query the authenticated user and get no login.
+func (c *Collector) resolveLogin(ctx context.Context, client *github.Client, user config.User) string {
+	if user.IsApp() {
+		return ""
+	}
+
+	c.mu.RLock()
+	login, ok := c.logins[user.Key()]
+	c.mu.RUnlock()
+	if ok {
+		return login
+	}
+	if c.cache != nil {
+		if login, ok := c.cache.login(user.Key()); ok {
+			return login
+		}
+	}
+
+	u, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		log.Printf("Error fetching login for user %s on %s: %v", user.Name, user.Host(), err)
+		return ""
+	}
+
+	c.mu.Lock()
+	c.logins[user.Key()] = u.GetLogin()
+	c.mu.Unlock()
+	if c.cache != nil {
+		c.cache.setLogin(user.Key(), u.GetLogin())
+	}
+
+	return u.GetLogin()
+}
+
+// expireStale drops the rate limit series of users that haven't been fetched
+// successfully or updated by a proxied or reported response within the
+// staleness window, so a revoked token doesn't keep reporting its last known
+// values
+func (c *Collector) expireStale(now time.Time) {
+	if c.staleAfter <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping rate limit polling")
-			return
-		case <-ticker.C:
-			c.Update(ctx)
+	for _, user := range c.users {
+		last, ok := c.lastUpdate[user.Key()]
+		if !ok || now.Sub(last) < c.staleAfter {
+			continue
 		}
+
+		log.Printf("Rate limits for user %s on %s are stale since %s, dropping series", user.Name, user.Host(), last.Format(time.RFC3339))
+		c.deleteRateSeries(user)
+		delete(c.lastUpdate, user.Key())
+	}
+}
+
+// deleteUser drops the client, state and all series of a user
+func (c *Collector) deleteUser(user config.User) {
+	key := user.Key()
+	delete(c.clients, key)
+	delete(c.lastUpdate, key)
+	delete(c.logins, key)
+
+	c.deleteRateSeries(user)
+	c.deleteSeries(user)
+	c.consumption.forget(key)
+	delete(c.circuits, key)
+}
+
+// deleteSeries removes all series of a user, keeping its state
+func (c *Collector) deleteSeries(user config.User) {
+	labels := prometheus.Labels{"user": user.Name, "host": user.Host()}
+
+	for _, m := range c.rateMetrics {
+		m.deletePartialMatch(labels)
+	}
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.deletePartialMatch(labels)
+	}
+	c.burnRate.deletePartialMatch(labels)
+	c.health.deletePartialMatch(labels)
+	c.tokens.deletePartialMatch(labels)
+	c.consumption.deletePartialMatch(labels)
+	c.secondary.deletePartialMatch(labels)
+	c.circuitMetrics.deletePartialMatch(labels)
+	c.pollInterval.DeletePartialMatch(labels)
+}
+
+// deleteRateSeries removes all rate limit series of a user
+func (c *Collector) deleteRateSeries(user config.User) {
+	labels := prometheus.Labels{"user": user.Name, "host": user.Host()}
+
+	for _, m := range c.rateMetrics {
+		m.deletePartialMatch(labels)
+	}
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.deletePartialMatch(labels)
+	}
+	c.burnRate.deletePartialMatch(labels)
+	c.burnRate.forget(user.Key())
+	delete(c.quotas, user.Key())
+}
+
+// deleteResourceSeries drops the series and history of one bucket of a user
+func (c *Collector) deleteResourceSeries(user config.User, resource string) {
+	labels := prometheus.Labels{"user": user.Name, "host": user.Host()}
+	if m, ok := c.rateMetrics[resource]; ok {
+		m.deletePartialMatch(labels)
 	}
+
+	labels["resource"] = resource
+	if c.labelledMetrics != nil {
+		c.labelledMetrics.deletePartialMatch(labels)
+	}
+	c.burnRate.deletePartialMatch(labels)
+	c.consumption.deletePartialMatch(labels)
+
+	delete(c.burnRate.history[user.Key()], resource)
+	delete(c.consumption.last[user.Key()], resource)
+	delete(c.quotas[user.Key()], resource)
+}
+
+// sameAccount reports whether two configurations of a user authenticate the
+// same way against the same endpoints, ignoring settings like poll intervals
+func sameAccount(a, b config.User) bool {
+	a.PollInterval, b.PollInterval = 0, 0
+	a.Resources, b.Resources = nil, nil
+	a.Labels, b.Labels = nil, nil
+	return reflect.DeepEqual(a, b)
 }
@@ -0,0 +1,896 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+const rateLimitResponse = `{
+  "resources": {
+    "core": {"limit": 5000, "remaining": 4990, "used": 10, "reset": 1700000000},
+    "search": {"limit": 30, "remaining": 28, "used": 2, "reset": 1700000060},
+    "graphql": {"limit": 5000, "remaining": 5000, "used": 0, "reset": 1700003600},
+    "code_search": {"limit": 10, "remaining": 3, "used": 7, "reset": 1700000030},
+    "actions_runner_registration": {"limit": 10000, "remaining": 9999, "used": 1, "reset": 1700003600}
+  },
+  "rate": {"limit": 5000, "remaining": 4990, "used": 10, "reset": 1700000000}
+}`
+
+// newTestServer serves a fixed /rate_limit response and a /user login
+func newTestServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/rate_limit":
+			w.Header().Set("X-OAuth-Scopes", "repo, read:org")
+			w.Header().Set("GitHub-Authentication-Token-Expiration", "2023-11-14 22:13:20 UTC")
+			w.Write([]byte(body))
+		case "/api/v3/user":
+			w.Write([]byte(`{"login": "octo-bot"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newTestCollector(t *testing.T, layout string, users ...config.User) *Collector {
+	t.Helper()
+
+	c, err := NewCollector(&config.Config{Users: users, MetricLayout: layout})
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	return c
+}
+
+func TestCollector_Update(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	c := newTestCollector(t, config.MetricLayoutLegacy, config.User{Name: "bot", Token: "token", BaseURL: server.URL})
+
+	c.Update(context.Background())
+
+	expected := `
+# HELP github_rate_limit_code_search_remaining GitHub API code search rate limit remaining
+# TYPE github_rate_limit_code_search_remaining gauge
+github_rate_limit_code_search_remaining{host="127.0.0.1",user="bot"} 3
+# HELP github_rate_limit_core_used GitHub API core rate limit used
+# TYPE github_rate_limit_core_used gauge
+github_rate_limit_core_used{host="127.0.0.1",user="bot"} 10
+# HELP github_rate_limit_search_reset_timestamp GitHub API search rate limit reset timestamp
+# TYPE github_rate_limit_search_reset_timestamp gauge
+github_rate_limit_search_reset_timestamp{host="127.0.0.1",user="bot"} 1.70000006e+09
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"github_rate_limit_code_search_remaining",
+		"github_rate_limit_core_used",
+		"github_rate_limit_search_reset_timestamp",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Buckets missing from the response are not exported
+	if n := testutil.CollectAndCount(c, "github_rate_limit_audit_log_limit"); n != 0 {
+		t.Errorf("Expected no audit_log series, got %d", n)
+	}
+}
+
+func TestCollector_ResourceLayout(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	c := newTestCollector(t, config.MetricLayoutResource, config.User{Name: "bot", Token: "token", BaseURL: server.URL})
+
+	c.Update(context.Background())
+
+	expected := `
+# HELP github_rate_limit_remaining GitHub API rate limit remaining
+# TYPE github_rate_limit_remaining gauge
+github_rate_limit_remaining{host="127.0.0.1",resource="actions_runner_registration",user="bot"} 9999
+github_rate_limit_remaining{host="127.0.0.1",resource="code_search",user="bot"} 3
+github_rate_limit_remaining{host="127.0.0.1",resource="core",user="bot"} 4990
+github_rate_limit_remaining{host="127.0.0.1",resource="graphql",user="bot"} 5000
+github_rate_limit_remaining{host="127.0.0.1",resource="search",user="bot"} 28
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_rate_limit_remaining"); err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 0 {
+		t.Errorf("Expected no legacy series with the resource layout, got %d", n)
+	}
+}
+
+func TestCollector_FetchErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "Bad credentials"}`))
+	}))
+	defer server.Close()
+
+	c := newTestCollector(t, config.MetricLayoutLegacy, config.User{Name: "revoked", Token: "token", BaseURL: server.URL})
+
+	c.Update(context.Background())
+	// Rejected tokens aren't polled again until a reload
+	c.Update(context.Background())
+
+	expected := `
+# HELP github_rate_limit_fetch_errors_total Total number of failed rate limit fetches by reason
+# TYPE github_rate_limit_fetch_errors_total counter
+github_rate_limit_fetch_errors_total{host="127.0.0.1",reason="unauthorized",user="revoked"} 1
+# HELP github_rate_limit_up Whether the last rate limit fetch for the user succeeded
+# TYPE github_rate_limit_up gauge
+github_rate_limit_up{host="127.0.0.1",user="revoked"} 0
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"github_rate_limit_fetch_errors_total",
+		"github_rate_limit_up",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(c, "github_rate_limit_last_success_timestamp_seconds"); n != 0 {
+		t.Errorf("Expected no last success timestamp, got %d series", n)
+	}
+}
+
+func TestCollector_ExpireStale(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	c, err := NewCollector(&config.Config{
+		Users:        []config.User{{Name: "bot", Token: "token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutBoth,
+		StaleAfter:   300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	c.Update(context.Background())
+
+	c.expireStale(time.Now().Add(time.Minute))
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 1 {
+		t.Fatalf("Expected fresh series to be kept, got %d", n)
+	}
+
+	c.expireStale(time.Now().Add(10 * time.Minute))
+	for _, name := range []string{"github_rate_limit_core_remaining", "github_rate_limit_remaining"} {
+		if n := testutil.CollectAndCount(c, name); n != 0 {
+			t.Errorf("Expected stale %s series to be dropped, got %d", name, n)
+		}
+	}
+
+	// Health metrics outlive the rate limit series
+	if n := testutil.CollectAndCount(c, "github_rate_limit_up"); n != 1 {
+		t.Errorf("Expected github_rate_limit_up to be kept, got %d", n)
+	}
+
+	// Series recreated by an observed response expire as well
+	user := config.User{Name: "bot", Token: "token", BaseURL: server.URL}
+	seen := time.Now()
+	if err := c.ObserveQuota(Quota{User: user, Resource: "core", Limit: 5000, Remaining: 4000, Used: 1000, Reset: seen.Add(time.Hour), UpdatedAt: seen}); err != nil {
+		t.Fatal("Expected the observation to be accepted")
+	}
+	c.expireStale(seen.Add(time.Minute))
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 1 {
+		t.Fatalf("Expected observed series to be kept, got %d", n)
+	}
+	c.expireStale(seen.Add(10 * time.Minute))
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 0 {
+		t.Errorf("Expected stale observed series to be dropped, got %d", n)
+	}
+}
+
+func TestCollector_Reload(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	keep := config.User{Name: "keep", Token: "token", BaseURL: server.URL}
+	remove := config.User{Name: "remove", Token: "token", BaseURL: server.URL}
+
+	c := newTestCollector(t, config.MetricLayoutLegacy, keep, remove)
+	c.Update(context.Background())
+
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 2 {
+		t.Fatalf("Expected 2 series before reload, got %d", n)
+	}
+
+	keepClient := c.clients[keep.Key()]
+	rotated := config.User{Name: "rotated", Token: "old", BaseURL: server.URL}
+	if err := c.Reload(&config.Config{Users: []config.User{keep, rotated}}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	rotatedClient := c.clients[rotated.Key()]
+	rotated.Token = "new"
+	if err := c.Reload(&config.Config{Users: []config.User{keep, rotated}}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if c.clients[keep.Key()] != keepClient {
+		t.Error("Expected client of unchanged user to be kept")
+	}
+
+	if c.clients[rotated.Key()] == rotatedClient {
+		t.Error("Expected client of user with a new token to be replaced")
+	}
+
+	if _, ok := c.clients[remove.Key()]; ok {
+		t.Error("Expected client of removed user to be dropped")
+	}
+
+	// Series of the removed user disappear immediately
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 1 {
+		t.Errorf("Expected 1 series after reload, got %d", n)
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_up"); n != 1 {
+		t.Errorf("Expected 1 up series after reload, got %d", n)
+	}
+
+	c.Update(context.Background())
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 2 {
+		t.Errorf("Expected 2 series after updating reloaded users, got %d", n)
+	}
+}
+
+// reloadDuringFetch fetches the rate limits of user, pointed at a test server,
+// and applies the config returned by reload while the fetch is in flight
+func reloadDuringFetch(t *testing.T, user config.User, reload func(user config.User) *config.Config) *Collector {
+	t.Helper()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/rate_limit" {
+			http.NotFound(w, r)
+			return
+		}
+		close(started)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(rateLimitResponse))
+	}))
+	t.Cleanup(server.Close)
+
+	user.BaseURL = server.URL
+	c := newTestCollector(t, config.MetricLayoutLegacy, user)
+
+	done := make(chan struct{})
+	go func() {
+		c.updateUserRateLimits(context.Background(), user)
+		close(done)
+	}()
+
+	<-started
+	if err := c.Reload(reload(user)); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	close(release)
+	<-done
+
+	return c
+}
+
+func TestSameAccount(t *testing.T) {
+	app := config.User{Name: "release-app", AppID: 1, InstallationID: 2, PrivateKeyPath: "app.pem", PrivateKey: []byte("old key")}
+
+	changed := app
+	changed.Resources = []string{"core"}
+	changed.Labels = map[string]string{"team": "platform"}
+	if !sameAccount(app, changed) {
+		t.Error("Expected the same account when only resources and labels changed")
+	}
+
+	// A key rotated in place keeps its path
+	rotated := app
+	rotated.PrivateKey = []byte("new key")
+	if sameAccount(app, rotated) {
+		t.Error("Expected a rotated private key to be a different account")
+	}
+}
+
+func TestCollector_ReloadDuringFetch(t *testing.T) {
+	c := reloadDuringFetch(t, config.User{Name: "remove", Token: "token"}, func(config.User) *config.Config {
+		return &config.Config{}
+	})
+
+	// The fetch of a removed user leaves no series behind
+	for _, name := range []string{"github_rate_limit_fetch_duration_seconds", "github_rate_limit_up", "github_rate_limit_core_remaining"} {
+		if n := testutil.CollectAndCount(c, name); n != 0 {
+			t.Errorf("Expected no %s series for a removed user, got %d", name, n)
+		}
+	}
+}
+
+func TestCollector_ReloadLabelsDuringFetch(t *testing.T) {
+	user := config.User{Name: "bot", Token: "token", Labels: map[string]string{"team": "a"}}
+	c := reloadDuringFetch(t, user, func(user config.User) *config.Config {
+		user.Labels = map[string]string{"team": "b"}
+		return &config.Config{Users: []config.User{user}}
+	})
+
+	// The fetch lands under the new label values only
+	expected := `
+# HELP github_rate_limit_up Whether the last rate limit fetch for the user succeeded
+# TYPE github_rate_limit_up gauge
+github_rate_limit_up{host="127.0.0.1",team="b",user="bot"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_rate_limit_up"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+	for _, name := range []string{"github_rate_limit_fetch_duration_seconds", "github_rate_limit_core_remaining"} {
+		if n := testutil.CollectAndCount(c, name); n != 1 {
+			t.Errorf("Expected 1 %s series, got %d", name, n)
+		}
+	}
+}
+
+func TestCollector_ReloadResourcesDuringFetch(t *testing.T) {
+	c := reloadDuringFetch(t, config.User{Name: "bot", Token: "token"}, func(user config.User) *config.Config {
+		user.Resources = []string{"search"}
+		return &config.Config{Users: []config.User{user}}
+	})
+
+	// Buckets deselected during the fetch aren't exported again
+	if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 0 {
+		t.Errorf("Expected no core series after it was deselected, got %d", n)
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_search_remaining"); n != 1 {
+		t.Errorf("Expected 1 search series, got %d", n)
+	}
+}
+
+func TestQuota_RemainingAt(t *testing.T) {
+	reset := time.Unix(1700000000, 0)
+	q := Quota{Limit: 5000, Remaining: 120, Reset: reset}
+
+	if n := q.RemainingAt(reset); n != 120 {
+		t.Errorf("Expected 120 remaining until the reset, got %d", n)
+	}
+	if n := q.RemainingAt(reset.Add(time.Second)); n != 5000 {
+		t.Errorf("Expected a full bucket after the reset, got %d", n)
+	}
+}
+
+func TestCollector_TokenMetrics(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	c := newTestCollector(t, config.MetricLayoutLegacy, config.User{Name: "bot", Token: "ghp_token", BaseURL: server.URL})
+
+	c.Update(context.Background())
+
+	expected := `
+# HELP github_token_expiry_timestamp_seconds Expiration timestamp of the user's token, for tokens that expire
+# TYPE github_token_expiry_timestamp_seconds gauge
+github_token_expiry_timestamp_seconds{host="127.0.0.1",user="bot"} 1.7e+09
+# HELP github_token_info Information about the user's token, always 1
+# TYPE github_token_info gauge
+github_token_info{host="127.0.0.1",login="octo-bot",scopes="read:org,repo",token_type="classic",user="bot"} 1
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"github_token_expiry_timestamp_seconds",
+		"github_token_info",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConsumptionMetrics_Observe(t *testing.T) {
+	m := newConsumptionMetrics(nil)
+	labels := []string{"bot", "api.github.com"}
+	start := time.Unix(1700000000-3000, 0)
+
+	samples := []rate{
+		{Limit: 5000, Used: 100, Reset: 1700000000},
+		{Limit: 5000, Used: 250, Reset: 1700000000},
+		{Limit: 5000, Used: 400, Reset: 1700000000},
+		// Reset: new window with 30 requests made since
+		{Limit: 5000, Used: 30, Reset: 1700003600},
+		{Limit: 5000, Used: 80, Reset: 1700003600},
+	}
+	for i, r := range samples {
+		m.observe("api.github.com/bot", labels, "core", r, start.Add(time.Duration(i)*15*time.Minute))
+	}
+
+	if v := testutil.ToFloat64(m.consumed.WithLabelValues("bot", "api.github.com", "core")); v != 380 {
+		t.Errorf("Expected 380 consumed requests, got %v", v)
+	}
+
+	if v := testutil.ToFloat64(m.resets.WithLabelValues("bot", "api.github.com", "core")); v != 1 {
+		t.Errorf("Expected 1 reset, got %v", v)
+	}
+}
+
+func TestConsumptionMetrics_Idle(t *testing.T) {
+	m := newConsumptionMetrics(nil)
+	labels := []string{"bot", "api.github.com"}
+	start := time.Unix(1700000000, 0)
+
+	// GitHub reports the reset of an unused bucket as an hour from now
+	for i := range 5 {
+		now := start.Add(time.Duration(i) * time.Minute)
+		m.observe("api.github.com/bot", labels, "core", rate{Limit: 5000, Remaining: 5000, Reset: now.Add(time.Hour).Unix()}, now)
+	}
+
+	// A request starts the window, which then keeps its reset
+	now := start.Add(5 * time.Minute)
+	reset := now.Add(time.Hour).Unix()
+	m.observe("api.github.com/bot", labels, "core", rate{Limit: 5000, Remaining: 4990, Used: 10, Reset: reset}, now)
+	m.observe("api.github.com/bot", labels, "core", rate{Limit: 5000, Remaining: 4980, Used: 20, Reset: reset}, now.Add(time.Minute))
+
+	if v := testutil.ToFloat64(m.resets.WithLabelValues("bot", "api.github.com", "core")); v != 0 {
+		t.Errorf("Expected no resets of an idle bucket, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.consumed.WithLabelValues("bot", "api.github.com", "core")); v != 20 {
+		t.Errorf("Expected 20 consumed requests, got %v", v)
+	}
+
+	// Passing the reset starts a new window, even with the same used count
+	m.observe("api.github.com/bot", labels, "core", rate{Limit: 5000, Remaining: 4980, Used: 20, Reset: reset + 3600}, time.Unix(reset, 0))
+	if v := testutil.ToFloat64(m.resets.WithLabelValues("bot", "api.github.com", "core")); v != 1 {
+		t.Errorf("Expected 1 reset after the window ended, got %v", v)
+	}
+}
+
+func TestCollector_ScrapeMode(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/rate_limit":
+			fetches.Add(1)
+			// Keep the fetch in flight long enough for scrapes to overlap
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(rateLimitResponse))
+		case "/api/v3/user":
+			w.Write([]byte(`{"login": "octo-bot"}`))
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewCollector(&config.Config{
+		Users:          []config.User{{Name: "bot", Token: "token", BaseURL: server.URL}},
+		MetricLayout:   config.MetricLayoutLegacy,
+		CollectionMode: config.CollectionModeScrape,
+		ScrapeTimeout:  5,
+		ScrapeCacheTTL: 60,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n := testutil.CollectAndCount(c, "github_rate_limit_core_remaining"); n != 1 {
+				t.Errorf("Expected 1 series from a scrape, got %d", n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Served from the cache within the TTL
+	testutil.CollectAndCount(c, "github_rate_limit_core_remaining")
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected concurrent and cached scrapes to share 1 fetch, got %d", n)
+	}
+
+	c.scrape.mu.Lock()
+	c.scrape.lastFetch = time.Now().Add(-time.Hour)
+	c.scrape.mu.Unlock()
+
+	testutil.CollectAndCount(c, "github_rate_limit_core_remaining")
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected a new fetch once the cache expired, got %d fetches", n)
+	}
+}
+
+func TestCollector_ObserveHeaders(t *testing.T) {
+	user := config.User{Name: "bot", Token: "token"}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+
+	header := func(remaining, used int, reset int64) http.Header {
+		h := http.Header{}
+		h.Set("X-RateLimit-Limit", "5000")
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("X-RateLimit-Used", strconv.Itoa(used))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		h.Set("X-RateLimit-Resource", "search")
+		return h
+	}
+
+	reset := time.Now().Add(time.Minute).Unix()
+	if resource := c.ObserveHeaders(user, header(20, 10, reset)); resource != "search" {
+		t.Errorf("Expected search resource, got %q", resource)
+	}
+	// A response that was sent earlier but arrived later is ignored
+	c.ObserveHeaders(user, header(25, 5, reset))
+
+	remaining := c.labelledMetrics.remaining.WithLabelValues("bot", "api.github.com", "search")
+	if v := testutil.ToFloat64(remaining); v != 20 {
+		t.Errorf("Expected 20 remaining, got %v", v)
+	}
+
+	// A new window replaces the state
+	c.ObserveHeaders(user, header(29, 1, reset+60))
+	if v := testutil.ToFloat64(remaining); v != 29 {
+		t.Errorf("Expected 29 remaining after reset, got %v", v)
+	}
+
+	if resource := c.ObserveHeaders(user, http.Header{}); resource != "" {
+		t.Errorf("Expected no resource without headers, got %q", resource)
+	}
+}
+
+func TestSecondaryLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		header     map[string]string
+		body       string
+		retryAfter time.Duration
+		ok         bool
+	}{
+		{"429 with retry after", http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}, "", 30 * time.Second, true},
+		{"429 without retry after", http.StatusTooManyRequests, nil, "", time.Minute, true},
+		{"429 primary exhausted", http.StatusTooManyRequests, map[string]string{"X-RateLimit-Remaining": "0"}, "", 0, false},
+		{"403 secondary", http.StatusForbidden, map[string]string{"Retry-After": "90"},
+			`{"message": "You have exceeded a secondary rate limit", "documentation_url": "https://docs.github.com/rest/overview/rate-limits-for-the-rest-api#about-secondary-rate-limits"}`, 90 * time.Second, true},
+		{"403 permissions", http.StatusForbidden, nil, `{"message": "Resource not accessible by integration"}`, 0, false},
+		{"200", http.StatusOK, nil, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			for k, v := range tt.header {
+				rec.Header().Set(k, v)
+			}
+			rec.WriteHeader(tt.status)
+			rec.WriteString(tt.body)
+			resp := rec.Result()
+			resp.Request = httptest.NewRequest(http.MethodGet, "/repos/org/repo", nil)
+
+			retryAfter, ok := SecondaryLimit(resp)
+			if ok != tt.ok || retryAfter != tt.retryAfter {
+				t.Errorf("Expected (%v, %v), got (%v, %v)", tt.retryAfter, tt.ok, retryAfter, ok)
+			}
+		})
+	}
+}
+
+func TestCollector_SecondaryLimitOnPoll(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "45")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := newTestCollector(t, config.MetricLayoutResource, config.User{Name: "bot", Token: "token", BaseURL: server.URL})
+	c.Update(context.Background())
+
+	if v := testutil.ToFloat64(c.secondary.hits.WithLabelValues("bot", "127.0.0.1")); v != 1 {
+		t.Errorf("Expected 1 secondary limit hit, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.secondary.retryAfter.WithLabelValues("bot", "127.0.0.1")); v != 45 {
+		t.Errorf("Expected retry after of 45 seconds, got %v", v)
+	}
+}
+
+func TestCollector_ObserveQuotaFreshness(t *testing.T) {
+	user := config.User{Name: "bot", Token: "token"}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+
+	now := time.Now()
+	reset := now.Add(30 * time.Minute)
+	quota := func(used int, reset, at time.Time) Quota {
+		return Quota{User: user, Resource: "core", Limit: 5000, Remaining: 5000 - used, Used: used, Reset: reset, UpdatedAt: at}
+	}
+
+	steps := []struct {
+		name     string
+		quota    Quota
+		expected bool
+	}{
+		{"first state", quota(100, reset, now), true},
+		{"same state seen earlier", quota(100, reset, now.Add(-time.Minute)), false},
+		{"more used, reported late", quota(150, reset, now.Add(-time.Minute)), true},
+		{"less used in the same window", quota(120, reset, now), false},
+		{"previous window", quota(4000, reset.Add(-time.Hour), now), false},
+		{"next window", quota(5, reset.Add(time.Hour), now), true},
+	}
+
+	for _, step := range steps {
+		err := c.ObserveQuota(step.quota)
+		if accepted := err == nil; accepted != step.expected {
+			t.Errorf("%s: expected accepted=%v, got %v", step.name, step.expected, err)
+		}
+		if err != nil && !errors.Is(err, ErrStaleQuota) {
+			t.Errorf("%s: expected a stale state, got %v", step.name, err)
+		}
+	}
+
+	if q := c.Quotas("core"); len(q) != 1 || q[0].Used != 5 {
+		t.Errorf("Expected the next window's state to win, got %+v", q)
+	}
+
+	if err := c.ObserveQuota(Quota{User: config.User{Name: "unknown", Token: "token"}, Resource: "core"}); err == nil || errors.Is(err, ErrStaleQuota) {
+		t.Errorf("Expected state of an unknown user to be rejected, got %v", err)
+	}
+	if err := c.ObserveQuota(Quota{User: user, Resource: "made_up_bucket", Limit: 10, Reset: reset, UpdatedAt: now}); err == nil || errors.Is(err, ErrStaleQuota) {
+		t.Errorf("Expected state of an unknown bucket to be rejected, got %v", err)
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_remaining"); n != 1 {
+		t.Errorf("Expected only the core series, got %d", n)
+	}
+}
+
+func TestCollector_CircuitBackoff(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	user := config.User{Name: "bot", Token: "token", BaseURL: server.URL}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+
+	c.Update(context.Background())
+	c.Update(context.Background())
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("Expected the second update to back off, got %d fetches", n)
+	}
+
+	open := c.circuitMetrics.state.WithLabelValues("bot", "127.0.0.1", circuitOpen)
+	if v := testutil.ToFloat64(open); v != 1 {
+		t.Errorf("Expected open circuit, got %v", v)
+	}
+
+	// Server errors are retried once the backoff has passed
+	c.circuits[user.Key()].retryAt = time.Now().Add(-time.Second)
+	c.Update(context.Background())
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected a retry after the backoff, got %d fetches", n)
+	}
+	if failures := c.circuits[user.Key()].failures; failures != 2 {
+		t.Errorf("Expected 2 consecutive failures, got %d", failures)
+	}
+}
+
+func TestCollector_CircuitDisabledUntilReload(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	user := config.User{Name: "bot", Token: "token", BaseURL: server.URL}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+	quota := Quota{User: user, Resource: "core", Limit: 5000, Remaining: 4000, Used: 1000, Reset: time.Now().Add(time.Hour)}
+	c.ObserveQuota(quota)
+
+	c.Update(context.Background())
+	if q := c.Quotas("core"); len(q) != 0 {
+		t.Errorf("Expected the quota of a rejected token to be dropped, got %+v", q)
+	}
+	if err := c.ObserveQuota(quota); err == nil || errors.Is(err, ErrStaleQuota) {
+		t.Errorf("Expected observations of a rejected token to be rejected, got %v", err)
+	}
+
+	c.circuits[user.Key()].retryAt = time.Now().Add(-time.Second)
+	c.Update(context.Background())
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("Expected a rejected token not to be polled again, got %d fetches", n)
+	}
+
+	disabled := c.circuitMetrics.state.WithLabelValues("bot", "127.0.0.1", circuitDisabled)
+	if v := testutil.ToFloat64(disabled); v != 1 {
+		t.Errorf("Expected disabled circuit, got %v", v)
+	}
+
+	if err := c.Reload(&config.Config{Users: []config.User{user}}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	c.Update(context.Background())
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected polling to resume after reload, got %d fetches", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{1: minBackoff, 3: 4 * minBackoff, 10: maxBackoff, 100: maxBackoff} {
+		d := backoff(failures)
+		if d < expected/2 || d > expected {
+			t.Errorf("Expected backoff after %d failures within [%s, %s], got %s", failures, expected/2, expected, d)
+		}
+	}
+}
+
+func TestCollector_ResourceSelection(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	user := config.User{Name: "bot", Token: "token", BaseURL: server.URL, Resources: []string{"core", "search"}}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+
+	c.Update(context.Background())
+	if n := testutil.CollectAndCount(c, "github_rate_limit_remaining"); n != 2 {
+		t.Fatalf("Expected 2 selected buckets, got %d", n)
+	}
+
+	// Changing settings only keeps the client and drops deselected buckets
+	client := c.clients[user.Key()]
+	changed := user
+	changed.Resources = []string{"core"}
+	changed.PollInterval = 15
+	if err := c.Reload(&config.Config{Users: []config.User{changed}}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if c.clients[user.Key()] != client {
+		t.Error("Expected the client to be kept when only settings changed")
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_remaining"); n != 1 {
+		t.Errorf("Expected 1 selected bucket after reload, got %d", n)
+	}
+
+	changed.Resources = []string{"nonexistent"}
+	if err := c.Reload(&config.Config{Users: []config.User{changed}}); err == nil {
+		t.Error("Expected error for unknown resource")
+	}
+}
+
+func TestCollector_CustomLabels(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	user := config.User{Name: "bot", Token: "token", BaseURL: server.URL, Resources: []string{"core"},
+		Labels: map[string]string{"team": "platform", "env": "prod"}}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+
+	c.Update(context.Background())
+
+	expected := `
+# HELP github_rate_limit_remaining GitHub API rate limit remaining
+# TYPE github_rate_limit_remaining gauge
+github_rate_limit_remaining{env="prod",host="127.0.0.1",resource="core",team="platform",user="bot"} 4990
+# HELP github_rate_limit_up Whether the last rate limit fetch for the user succeeded
+# TYPE github_rate_limit_up gauge
+github_rate_limit_up{env="prod",host="127.0.0.1",team="platform",user="bot"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_rate_limit_remaining", "github_rate_limit_up"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+
+	// New label values replace the series, under the same client
+	client := c.clients[user.Key()]
+	changed := user
+	changed.Labels = map[string]string{"team": "security", "env": "prod"}
+	if err := c.Reload(&config.Config{Users: []config.User{changed}}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if c.clients[user.Key()] != client {
+		t.Error("Expected the client to be kept when only labels changed")
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_remaining"); n != 0 {
+		t.Errorf("Expected series with the old labels dropped, got %d", n)
+	}
+
+	c.Update(context.Background())
+	expected = `
+# HELP github_rate_limit_remaining GitHub API rate limit remaining
+# TYPE github_rate_limit_remaining gauge
+github_rate_limit_remaining{env="prod",host="127.0.0.1",resource="core",team="security",user="bot"} 4990
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_rate_limit_remaining"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+
+	// Label names are fixed by the metric families
+	changed.Labels = map[string]string{"team": "security"}
+	if err := c.Reload(&config.Config{Users: []config.User{changed}}); err == nil {
+		t.Error("Expected error for changed label names")
+	}
+}
+
+func TestCollector_Groups(t *testing.T) {
+	users := []config.User{
+		{Name: "pool-1", Token: "token"},
+		{Name: "pool-2", Token: "token"},
+		{Name: "pool-3", Token: "token"},
+		{Name: "other", Token: "token"},
+	}
+	c, err := NewCollector(&config.Config{
+		Users:        users,
+		MetricLayout: config.MetricLayoutResource,
+		Groups:       []config.Group{{Name: "ci", Users: []string{"pool-1", "pool-2", "api.github.com/pool-3"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	now := time.Now()
+	soon, later := now.Add(10*time.Minute).Truncate(time.Second), now.Add(time.Hour).Truncate(time.Second)
+	for _, q := range []Quota{
+		{User: users[0], Resource: "core", Limit: 5000, Remaining: 0, Used: 5000, Reset: later},
+		{User: users[1], Resource: "core", Limit: 5000, Remaining: 1200, Used: 3800, Reset: soon},
+		// Past its reset, so full again
+		{User: users[2], Resource: "core", Limit: 5000, Remaining: 10, Used: 4990, Reset: now.Add(-time.Minute), UpdatedAt: now.Add(-2 * time.Minute)},
+		{User: users[3], Resource: "core", Limit: 5000, Remaining: 0, Used: 5000, Reset: later},
+	} {
+		if err := c.ObserveQuota(q); err != nil {
+			t.Fatalf("Expected quota of %s to be accepted, got %v", q.User.Name, err)
+		}
+	}
+
+	expected := fmt.Sprintf(`
+# HELP github_rate_limit_group_exhausted_members Number of group members with no requests remaining in the bucket
+# TYPE github_rate_limit_group_exhausted_members gauge
+github_rate_limit_group_exhausted_members{group="ci",resource="core"} 1
+# HELP github_rate_limit_group_limit Rate limit of the bucket across all group members
+# TYPE github_rate_limit_group_limit gauge
+github_rate_limit_group_limit{group="ci",resource="core"} 15000
+# HELP github_rate_limit_group_members Number of group members with a known state of the bucket
+# TYPE github_rate_limit_group_members gauge
+github_rate_limit_group_members{group="ci",resource="core"} 3
+# HELP github_rate_limit_group_min_remaining Fewest requests remaining in the bucket of any group member
+# TYPE github_rate_limit_group_min_remaining gauge
+github_rate_limit_group_min_remaining{group="ci",resource="core"} 0
+# HELP github_rate_limit_group_remaining Requests remaining in the bucket across all group members
+# TYPE github_rate_limit_group_remaining gauge
+github_rate_limit_group_remaining{group="ci",resource="core"} 6200
+# HELP github_rate_limit_group_reset_timestamp_seconds Earliest upcoming reset of the bucket of any group member in seconds since epoch
+# TYPE github_rate_limit_group_reset_timestamp_seconds gauge
+github_rate_limit_group_reset_timestamp_seconds{group="ci",resource="core"} %d
+`, soon.Unix())
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"github_rate_limit_group_exhausted_members", "github_rate_limit_group_limit", "github_rate_limit_group_members",
+		"github_rate_limit_group_min_remaining", "github_rate_limit_group_remaining", "github_rate_limit_group_reset_timestamp_seconds",
+	); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+
+	if quotas := c.GroupQuotas("core"); len(quotas) != 1 || quotas[0].Remaining != 6200 || quotas[0].Exhausted != 1 {
+		t.Errorf("Expected the ci group with 6200 remaining and 1 exhausted member, got %+v", quotas)
+	}
+
+	// Removed groups disappear with the next scrape
+	if err := c.Reload(&config.Config{Users: users}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if n := testutil.CollectAndCount(c, "github_rate_limit_group_remaining"); n != 0 {
+		t.Errorf("Expected no group series after removing the group, got %d", n)
+	}
+}
+
+func TestCollector_OnUpdate(t *testing.T) {
+	server := newTestServer(t, rateLimitResponse)
+	c := newTestCollector(t, config.MetricLayoutResource, config.User{Name: "bot", Token: "token", BaseURL: server.URL})
+
+	var calls atomic.Int32
+	c.OnUpdate(func() {
+		if len(c.Quotas("core")) == 1 {
+			calls.Add(1)
+		}
+	})
+	c.Update(context.Background())
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 call after the update with its rate limits, got %d", n)
+	}
+}
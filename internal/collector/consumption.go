@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consumptionMetrics turns the used gauge, which drops to zero on every reset,
+// into counters that keep increasing across reset windows
+type consumptionMetrics struct {
+	consumed *prometheus.CounterVec
+	resets   *prometheus.CounterVec
+
+	// last holds the previous sample, keyed by user key, then resource name
+	last map[string]map[string]rate
+}
+
+func newConsumptionMetrics(custom []string) *consumptionMetrics {
+	labels := metricLabels(custom, "resource")
+
+	return &consumptionMetrics{
+		consumed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "github_rate_limit_consumed_total",
+				Help: "Total number of requests consumed from the bucket, observed across reset windows",
+			},
+			labels,
+		),
+		resets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "github_rate_limit_resets_total",
+				Help: "Total number of bucket resets observed",
+			},
+			labels,
+		),
+		last: make(map[string]map[string]rate),
+	}
+}
+
+func (m *consumptionMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.consumed.Describe(ch)
+	m.resets.Describe(ch)
+}
+
+func (m *consumptionMetrics) collect(ch chan<- prometheus.Metric) {
+	m.consumed.Collect(ch)
+	m.resets.Collect(ch)
+}
+
+func (m *consumptionMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.consumed.DeletePartialMatch(labels)
+	m.resets.DeletePartialMatch(labels)
+}
+
+// forget drops the previous samples of a user
+func (m *consumptionMetrics) forget(key string) {
+	delete(m.last, key)
+}
+
+// observe compares a bucket sample with the previous one and counts the
+// requests made in between. A reset is detected by windowEnded; everything
+// used since then counts as consumed.
+// Requests made between the previous poll and the reset can't be seen and are
+// missed.
+func (m *consumptionMetrics) observe(key string, labels []string, resource string, r rate, now time.Time) {
+	values := withResource(labels, resource)
+	consumed := m.consumed.WithLabelValues(values...)
+	resets := m.resets.WithLabelValues(values...)
+
+	resources, ok := m.last[key]
+	if !ok {
+		resources = make(map[string]rate)
+		m.last[key] = resources
+	}
+
+	prev, ok := resources[resource]
+	resources[resource] = r
+
+	// Nothing to compare the first sample with
+	if !ok {
+		return
+	}
+
+	if windowEnded(prev, r, now) {
+		resets.Inc()
+		consumed.Add(float64(r.Used))
+		return
+	}
+
+	consumed.Add(float64(r.Used - prev.Used))
+}
@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// groupMetrics aggregates the buckets of the members of each group, so a pool
+// of interchangeable tokens can be alerted on as a whole
+type groupMetrics struct {
+	members      *prometheus.GaugeVec
+	remaining    *prometheus.GaugeVec
+	limit        *prometheus.GaugeVec
+	minRemaining *prometheus.GaugeVec
+	exhausted    *prometheus.GaugeVec
+	reset        *prometheus.GaugeVec
+
+	// mu keeps concurrent scrapes from collecting each other's half-built
+	// aggregates
+	mu sync.Mutex
+}
+
+func newGroupMetrics() *groupMetrics {
+	labels := []string{"group", "resource"}
+
+	return &groupMetrics{
+		members: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_members",
+				Help: "Number of group members with a known state of the bucket",
+			},
+			labels,
+		),
+		remaining: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_remaining",
+				Help: "Requests remaining in the bucket across all group members",
+			},
+			labels,
+		),
+		limit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_limit",
+				Help: "Rate limit of the bucket across all group members",
+			},
+			labels,
+		),
+		minRemaining: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_min_remaining",
+				Help: "Fewest requests remaining in the bucket of any group member",
+			},
+			labels,
+		),
+		exhausted: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_exhausted_members",
+				Help: "Number of group members with no requests remaining in the bucket",
+			},
+			labels,
+		),
+		reset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_group_reset_timestamp_seconds",
+				Help: "Earliest upcoming reset of the bucket of any group member in seconds since epoch",
+			},
+			labels,
+		),
+	}
+}
+
+func (m *groupMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.members.Describe(ch)
+	m.remaining.Describe(ch)
+	m.limit.Describe(ch)
+	m.minRemaining.Describe(ch)
+	m.exhausted.Describe(ch)
+	m.reset.Describe(ch)
+}
+
+// GroupQuota is the combined state of a bucket across the members of a group
+type GroupQuota struct {
+	Group    string
+	Resource string
+	// Members is the number of members with a known state of the bucket
+	Members      int
+	Limit        int
+	Remaining    int
+	MinRemaining int
+	// Exhausted is the number of members with no requests remaining
+	Exhausted int
+	// Reset is the earliest upcoming reset, zero when every member's window
+	// has ended
+	Reset time.Time
+}
+
+// add counts the state of a member's bucket at now
+func (g *GroupQuota) add(q Quota, now time.Time) {
+	remaining := q.RemainingAt(now)
+	if !q.Ended(now) && (g.Reset.IsZero() || q.Reset.Before(g.Reset)) {
+		g.Reset = q.Reset
+	}
+
+	if g.Members == 0 || remaining < g.MinRemaining {
+		g.MinRemaining = remaining
+	}
+	if remaining == 0 {
+		g.Exhausted++
+	}
+	g.Members++
+	g.Remaining += remaining
+	g.Limit += q.Limit
+}
+
+// groupQuota aggregates the last known state of a bucket of a group's members.
+// Members without one, e.g. while failing or after their series went stale,
+// are left out.
+func (c *Collector) groupQuota(group config.Group, resource string, now time.Time) GroupQuota {
+	g := GroupQuota{Group: group.Name, Resource: resource}
+	for _, user := range c.users {
+		if !group.Includes(user) {
+			continue
+		}
+		if q, ok := c.quotas[user.Key()][resource]; ok {
+			g.add(q, now)
+		}
+	}
+	return g
+}
+
+// GroupQuotas returns the combined state of a bucket for every group with a
+// member that has one, in config order
+func (c *Collector) GroupQuotas(resource string) []GroupQuota {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	var quotas []GroupQuota
+	for _, group := range c.groups {
+		if g := c.groupQuota(group, resource, now); g.Members > 0 {
+			quotas = append(quotas, g)
+		}
+	}
+	return quotas
+}
+
+// collectGroups aggregates the last known buckets of each group's members and
+// sends the result
+func (c *Collector) collectGroups(ch chan<- prometheus.Metric, now time.Time) {
+	m := c.groupMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Groups and members may have changed since the previous scrape
+	m.members.Reset()
+	m.remaining.Reset()
+	m.limit.Reset()
+	m.minRemaining.Reset()
+	m.exhausted.Reset()
+	m.reset.Reset()
+
+	for _, group := range c.groups {
+		for _, res := range resources {
+			g := c.groupQuota(group, res.name, now)
+			if g.Members == 0 {
+				continue
+			}
+
+			labels := []string{group.Name, res.name}
+			m.members.WithLabelValues(labels...).Set(float64(g.Members))
+			m.remaining.WithLabelValues(labels...).Set(float64(g.Remaining))
+			m.limit.WithLabelValues(labels...).Set(float64(g.Limit))
+			m.minRemaining.WithLabelValues(labels...).Set(float64(g.MinRemaining))
+			m.exhausted.WithLabelValues(labels...).Set(float64(g.Exhausted))
+			if !g.Reset.IsZero() {
+				m.reset.WithLabelValues(labels...).Set(float64(g.Reset.Unix()))
+			}
+		}
+	}
+
+	m.members.Collect(ch)
+	m.remaining.Collect(ch)
+	m.limit.Collect(ch)
+	m.minRemaining.Collect(ch)
+	m.exhausted.Collect(ch)
+	m.reset.Collect(ch)
+}
@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// parseRateHeaders reads the X-RateLimit-* headers GitHub sends with every API
+// response. Responses without them, e.g. from endpoints that aren't rate
+// limited, return false.
+func parseRateHeaders(header http.Header) (string, rate, bool) {
+	var r rate
+	for name, dst := range map[string]*int{
+		"X-RateLimit-Limit":     &r.Limit,
+		"X-RateLimit-Remaining": &r.Remaining,
+		"X-RateLimit-Used":      &r.Used,
+	} {
+		v, err := strconv.Atoi(header.Get(name))
+		if err != nil {
+			return "", rate{}, false
+		}
+		*dst = v
+	}
+
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return "", rate{}, false
+	}
+	r.Reset = reset
+
+	// Older GitHub Enterprise Server releases don't name the bucket
+	resource := header.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = "core"
+	}
+
+	return resource, r, true
+}
+
+// ObserveHeaders updates the rate limits of a user from the headers of a
+// GitHub API response made with its credentials. It returns the bucket the
+// response counted against, or "" when the headers carry no rate limit.
+func (c *Collector) ObserveHeaders(user config.User, header http.Header) string {
+	resource, r, ok := parseRateHeaders(header)
+	if !ok {
+		return ""
+	}
+
+	c.ObserveQuota(Quota{
+		User:      user,
+		Resource:  resource,
+		Limit:     r.Limit,
+		Remaining: r.Remaining,
+		Used:      r.Used,
+		Reset:     time.Unix(r.Reset, 0),
+		UpdatedAt: time.Now(),
+	})
+
+	return resource
+}
+
+// ErrStaleQuota is returned by ObserveQuota for a bucket state older than the
+// one already known
+var ErrStaleQuota = errors.New("older than the known state")
+
+// ObserveQuota updates the rate limits of a user from a bucket state seen
+// outside of polling, e.g. reported by a client that called GitHub itself.
+// UpdatedAt is when the state was seen. It returns ErrStaleQuota when the
+// state is older than the one already known, and another error when the user
+// isn't polled or its token was rejected, or the bucket is unknown or not
+// selected for the user, which would add series for any name a caller makes
+// up.
+func (c *Collector) ObserveQuota(q Quota) error {
+	now := time.Now()
+	if q.UpdatedAt.IsZero() || q.UpdatedAt.After(now) {
+		q.UpdatedAt = now
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Only users that are polled have series to update, under the labels
+	// and buckets of their running configuration
+	current, ok := c.currentUser(q.User.Key())
+	if !ok {
+		return fmt.Errorf("user %s is not polled", q.User.Name)
+	}
+	if c.isDisabled(current) {
+		return fmt.Errorf("token of user %s was rejected", current.Name)
+	}
+	q.User = current
+	if !KnownResource(q.Resource) {
+		return fmt.Errorf("unknown resource %q", q.Resource)
+	}
+	if !q.User.ExportsResource(q.Resource) {
+		return fmt.Errorf("resource %q is not selected for user %s", q.Resource, q.User.Name)
+	}
+
+	r := q.rate()
+	if !c.isNewer(q.User, q.Resource, r, q.UpdatedAt) {
+		return ErrStaleQuota
+	}
+
+	c.setRate(q.User, c.userLabels(q.User), q.Resource, r, q.UpdatedAt)
+	// The series are as fresh as the observation, so they don't expire while
+	// the user's polls fail
+	if q.UpdatedAt.After(c.lastUpdate[q.User.Key()]) {
+		c.lastUpdate[q.User.Key()] = q.UpdatedAt
+	}
+
+	return nil
+}
+
+// isNewer tells whether a bucket state seen at a point in time is newer than
+// the last known one, no matter if either was polled or reported:
+//
+//   - once the known window has ended, any state is newer
+//   - a later reset is a newer window, an earlier one an older window
+//   - within a window the used count only grows, so a higher one is newer;
+//     with the same count, the state seen last wins
+//
+// Concurrent responses arrive out of order and clients report with a delay,
+// so comparing timestamps alone would move the gauges back.
+func (c *Collector) isNewer(user config.User, resource string, r rate, at time.Time) bool {
+	last, ok := c.quotas[user.Key()][resource]
+	if !ok || last.Ended(at) {
+		return true
+	}
+
+	switch reset := last.Reset.Unix(); {
+	case r.Reset != reset:
+		return r.Reset > reset
+	case r.Used != last.Used:
+		return r.Used > last.Used
+	default:
+		return !at.Before(last.UpdatedAt)
+	}
+}
@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fetch error reasons used in the reason label of github_rate_limit_fetch_errors_total
+const (
+	reasonUnauthorized = "unauthorized"
+	reasonForbidden    = "forbidden"
+	reasonRateLimited  = "rate_limited"
+	reasonNotFound     = "not_found"
+	reasonServerError  = "server_error"
+	reasonTimeout      = "timeout"
+	reasonNetwork      = "network"
+	reasonOther        = "other"
+)
+
+// healthMetrics describes how well fetching rate limits works for each user
+type healthMetrics struct {
+	up            *prometheus.GaugeVec
+	lastSuccess   *prometheus.GaugeVec
+	fetchErrors   *prometheus.CounterVec
+	fetchDuration *prometheus.HistogramVec
+}
+
+func newHealthMetrics(custom []string) *healthMetrics {
+	labels := metricLabels(custom)
+
+	return &healthMetrics{
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_up",
+				Help: "Whether the last rate limit fetch for the user succeeded",
+			},
+			labels,
+		),
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_rate_limit_last_success_timestamp_seconds",
+				Help: "Timestamp of the last successful rate limit fetch for the user",
+			},
+			labels,
+		),
+		fetchErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "github_rate_limit_fetch_errors_total",
+				Help: "Total number of failed rate limit fetches by reason",
+			},
+			metricLabels(custom, "reason"),
+		),
+		fetchDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "github_rate_limit_fetch_duration_seconds",
+				Help:    "Duration of rate limit fetches from the GitHub API",
+				Buckets: prometheus.DefBuckets,
+			},
+			labels,
+		),
+	}
+}
+
+func (m *healthMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.up.Describe(ch)
+	m.lastSuccess.Describe(ch)
+	m.fetchErrors.Describe(ch)
+	m.fetchDuration.Describe(ch)
+}
+
+func (m *healthMetrics) collect(ch chan<- prometheus.Metric) {
+	m.up.Collect(ch)
+	m.lastSuccess.Collect(ch)
+	m.fetchErrors.Collect(ch)
+	m.fetchDuration.Collect(ch)
+}
+
+func (m *healthMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.up.DeletePartialMatch(labels)
+	m.lastSuccess.DeletePartialMatch(labels)
+	m.fetchErrors.DeletePartialMatch(labels)
+	m.fetchDuration.DeletePartialMatch(labels)
+}
+
+// classifyError maps a fetch error to a reason label value
+func classifyError(err error) string {
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &rateLimitErr) || errors.As(err, &abuseErr) {
+		return reasonRateLimited
+	}
+
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		return classifyStatus(respErr.Response.StatusCode)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return reasonTimeout
+		}
+		return reasonNetwork
+	}
+
+	return reasonOther
+}
+
+// classifyStatus maps an HTTP status code to a reason label value
+func classifyStatus(code int) string {
+	switch {
+	case code == http.StatusUnauthorized:
+		return reasonUnauthorized
+	case code == http.StatusTooManyRequests:
+		return reasonRateLimited
+	case code == http.StatusForbidden:
+		return reasonForbidden
+	case code == http.StatusNotFound:
+		return reasonNotFound
+	case code >= 500:
+		return reasonServerError
+	default:
+		return reasonOther
+	}
+}
@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"sort"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Quota is the last known state of a rate limit bucket for a user
+type Quota struct {
+	User      config.User
+	Resource  string
+	Limit     int
+	Remaining int
+	Used      int
+	Reset     time.Time
+	// UpdatedAt is when the state was observed
+	UpdatedAt time.Time
+}
+
+// Ended reports whether the bucket's window has ended by now
+func (q Quota) Ended(now time.Time) bool {
+	return now.After(q.Reset)
+}
+
+// RemainingAt returns the requests left in the bucket at now. A bucket past
+// its reset is full again, whatever was last seen.
+func (q Quota) RemainingAt(now time.Time) int {
+	if q.Ended(now) {
+		return q.Limit
+	}
+	return q.Remaining
+}
+
+// SameWindow reports whether q is still in the window of an earlier state of
+// the bucket. A moved reset alone doesn't start a new window, since GitHub
+// moves the reset of a bucket nothing was used from along with the clock.
+func (q Quota) SameWindow(prev Quota) bool {
+	return !windowEnded(prev.rate(), q.rate(), q.UpdatedAt)
+}
+
+// rate returns the bucket state as reported by GitHub
+func (q Quota) rate() rate {
+	return rate{Limit: q.Limit, Remaining: q.Remaining, Used: q.Used, Reset: q.Reset.Unix()}
+}
+
+// Quotas returns the last known state of a bucket for every user that has
+// one, sorted by user key
+func (c *Collector) Quotas(resource string) []Quota {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var quotas []Quota
+	for _, user := range c.users {
+		if q, ok := c.quotas[user.Key()][resource]; ok {
+			// Credentials may have changed since the state was recorded
+			q.User = user
+			quotas = append(quotas, q)
+		}
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotas[i].User.Key() < quotas[j].User.Key()
+	})
+
+	return quotas
+}
+
+// setQuota records the state of a bucket for a user
+func (c *Collector) setQuota(user config.User, resource string, r rate, now time.Time) {
+	buckets, ok := c.quotas[user.Key()]
+	if !ok {
+		buckets = make(map[string]Quota)
+		c.quotas[user.Key()] = buckets
+	}
+
+	buckets[resource] = Quota{
+		User:      user,
+		Resource:  resource,
+		Limit:     r.Limit,
+		Remaining: r.Remaining,
+		Used:      r.Used,
+		Reset:     time.Unix(r.Reset, 0),
+		UpdatedAt: now,
+	}
+}
@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// resource describes a rate limit bucket returned by the /rate_limit endpoint.
+// Supporting a new bucket only takes a new entry in resources.
+type resource struct {
+	// name is the bucket key in the API response and the metric name segment
+	name string
+	// description is used in metric help texts
+	description string
+}
+
+var resources = []resource{
+	{name: "core", description: "core"},
+	{name: "search", description: "search"},
+	{name: "graphql", description: "GraphQL"},
+	{name: "integration_manifest", description: "integration manifest"},
+	{name: "source_import", description: "source import"},
+	{name: "code_scanning_upload", description: "code scanning upload"},
+	{name: "actions_runner_registration", description: "actions runner registration"},
+	{name: "scim", description: "SCIM"},
+	{name: "dependency_snapshots", description: "dependency snapshots"},
+	{name: "code_search", description: "code search"},
+	{name: "audit_log", description: "audit log"},
+}
+
+// Resources returns the names of the buckets the exporter knows, in the
+// order their metrics are registered
+func Resources() []string {
+	names := make([]string, 0, len(resources))
+	for _, res := range resources {
+		names = append(names, res.name)
+	}
+	return names
+}
+
+// rate is a single bucket of the /rate_limit response
+type rate struct {
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	Used      int   `json:"used"`
+	Reset     int64 `json:"reset"`
+}
+
+// windowEnded reports whether a bucket was reset between two of its samples.
+// GitHub moves the reset timestamp of a bucket nothing was used from along
+// with the clock, so a new timestamp alone doesn't mean a window ended: only
+// passing the previous reset or the used count going down does.
+func windowEnded(prev, r rate, now time.Time) bool {
+	if prev.Used == 0 && r.Used == 0 {
+		return false
+	}
+	return !now.Before(time.Unix(prev.Reset, 0)) || r.Used < prev.Used
+}
+
+// fetchRateLimits returns every bucket reported by the /rate_limit endpoint.
+//
+// go-github's RateLimits only knows a subset of the buckets, so the response
+// is decoded into a map instead. The request also goes straight to the HTTP
+// client to skip go-github's client-side check, which would refuse to send
+// it while the core bucket is exhausted.
+func fetchRateLimits(ctx context.Context, client *github.Client) (map[string]rate, *http.Response, error) {
+	req, err := client.NewRequest(http.MethodGet, "rate_limit", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := github.CheckResponse(resp); err != nil {
+		return nil, resp, err
+	}
+
+	var body struct {
+		Resources map[string]rate `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, resp, fmt.Errorf("failed to decode rate limit response: %w", err)
+	}
+
+	return body.Resources, resp, nil
+}
+
+// KnownResource reports whether a bucket name is one the exporter exports
+func KnownResource(name string) bool {
+	return slices.ContainsFunc(resources, func(r resource) bool { return r.name == name })
+}
+
+// validateResources checks that a user only selects known buckets
+func validateResources(user config.User) error {
+	for _, name := range user.Resources {
+		if !KnownResource(name) {
+			return fmt.Errorf("user %s: unknown resource %q", user.Name, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package collector
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// maxSchedulerWait bounds how long the scheduler sleeps, so users added by a
+// reload get scheduled promptly
+const maxSchedulerWait = time.Second
+
+// scheduler polls each user on its own schedule. First polls are spread evenly
+// over the poll interval with jitter, then every user is polled once per its
+// interval, so a large fleet doesn't hit the API all at once.
+type scheduler struct {
+	c *Collector
+	// interval is the default poll interval, users may override it
+	interval time.Duration
+
+	// next holds when each user is due, by user key
+	next map[string]time.Time
+	// adapted holds the intervals set by adaptive polling, by user key
+	adapted map[string]time.Duration
+
+	// inflight holds the user keys being fetched
+	inflight map[string]bool
+	mu       sync.Mutex
+}
+
+func newScheduler(c *Collector, interval time.Duration) *scheduler {
+	return &scheduler{
+		c:        c,
+		interval: interval,
+		next:     make(map[string]time.Time),
+		adapted:  make(map[string]time.Duration),
+		inflight: make(map[string]bool),
+	}
+}
+
+// baseInterval returns how often a user is polled without adaptive polling
+func (s *scheduler) baseInterval(user config.User) time.Duration {
+	return time.Duration(user.Interval(int(s.interval/time.Second))) * time.Second
+}
+
+// userInterval returns how often a user is polled
+func (s *scheduler) userInterval(user config.User) time.Duration {
+	if d, ok := s.adapted[user.Key()]; ok {
+		return d
+	}
+	return s.baseInterval(user)
+}
+
+// plan schedules new users and forgets removed ones. The i-th of n new users
+// gets the i-th slot of its interval, at a random point within the slot.
+func (s *scheduler) plan(users []config.User, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := make(map[string]bool, len(users))
+	var added []config.User
+	for _, user := range users {
+		keep[user.Key()] = true
+		next, ok := s.next[user.Key()]
+		if !ok {
+			added = append(added, user)
+			continue
+		}
+		// A reload may have shortened the interval
+		if latest := now.Add(s.userInterval(user)); next.After(latest) {
+			s.next[user.Key()] = latest
+		}
+	}
+
+	for key := range s.next {
+		if !keep[key] {
+			delete(s.next, key)
+			delete(s.adapted, key)
+		}
+	}
+
+	for i, user := range added {
+		slot := s.userInterval(user) / time.Duration(len(added))
+		offset := slot * time.Duration(i)
+		if slot > 0 {
+			offset += rand.N(slot)
+		}
+		s.next[user.Key()] = now.Add(offset)
+		s.c.pollInterval.WithLabelValues(s.c.userLabels(user)...).Set(s.userInterval(user).Seconds())
+	}
+}
+
+// due returns the users to fetch now and moves their schedules on by one
+// interval. Users still being fetched or backing off skip their turn.
+func (s *scheduler) due(users []config.User, now time.Time) []config.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []config.User
+	for _, user := range users {
+		next := s.next[user.Key()]
+		if now.Before(next) {
+			continue
+		}
+
+		// Skip turns missed while busy instead of catching up on them
+		interval := s.userInterval(user)
+		for !now.Before(next) {
+			next = next.Add(interval)
+		}
+		s.next[user.Key()] = next
+
+		if s.inflight[user.Key()] {
+			log.Printf("Fetch for user %s on %s is still running, skipping its turn", user.Name, user.Host())
+			continue
+		}
+		if !s.c.shouldFetch(user, now) {
+			continue
+		}
+
+		s.inflight[user.Key()] = true
+		due = append(due, user)
+	}
+
+	return due
+}
+
+// wait returns how long to sleep until the next user is due
+func (s *scheduler) wait(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wait := maxSchedulerWait
+	for _, next := range s.next {
+		wait = min(wait, next.Sub(now))
+	}
+	return max(wait, 0)
+}
+
+// done adapts the interval of a user after a fetch that started at started,
+// moving its next poll closer when the interval got shorter
+func (s *scheduler) done(user config.User, started time.Time) {
+	s.mu.Lock()
+	current := s.userInterval(user)
+	s.mu.Unlock()
+
+	interval := s.c.adaptInterval(user, s.baseInterval(user), current, time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, user.Key())
+	next, ok := s.next[user.Key()]
+	if !ok {
+		return
+	}
+
+	// The user may have been removed by a reload in the meantime, which the
+	// schedule only notices on the next plan
+	s.c.mu.RLock()
+	defer s.c.mu.RUnlock()
+	running, ok := s.c.currentUser(user.Key())
+	if !ok {
+		return
+	}
+
+	s.adapted[user.Key()] = interval
+	if sooner := started.Add(interval); sooner.Before(next) {
+		s.next[user.Key()] = sooner
+	}
+	s.c.pollInterval.WithLabelValues(s.c.userLabels(running)...).Set(interval.Seconds())
+}
+
+// StartPolling fetches rate limits in the background until ctx is done.
+// interval is the default poll interval, users may set their own. At most
+// poll_workers fetches run at a time.
+func (c *Collector) StartPolling(ctx context.Context, interval time.Duration) {
+	s := newScheduler(c, interval)
+
+	jobs := make(chan config.User)
+	var wg sync.WaitGroup
+	for range c.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range jobs {
+				started := time.Now()
+				c.updateUserRateLimits(ctx, user)
+				s.done(user, started)
+				c.updated()
+			}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			close(jobs)
+			wg.Wait()
+			log.Println("Stopping rate limit polling")
+			return
+		case <-timer.C:
+		}
+
+		c.mu.RLock()
+		users := c.users
+		c.mu.RUnlock()
+
+		now := time.Now()
+		s.plan(users, now)
+
+	dispatch:
+		for _, user := range s.due(users, now) {
+			select {
+			case jobs <- user:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+
+		c.expireStale(time.Now())
+		timer.Reset(s.wait(time.Now()))
+	}
+}
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func TestScheduler_Plan(t *testing.T) {
+	var users []config.User
+	for i := range 60 {
+		users = append(users, config.User{Name: fmt.Sprintf("bot-%d", i), Token: "token"})
+	}
+	users = append(users, config.User{Name: "dormant", Token: "token", PollInterval: 600})
+	s := newScheduler(newTestCollector(t, config.MetricLayoutResource, users...), time.Minute)
+
+	now := time.Now()
+	s.plan(users, now)
+
+	// Each of the 61 users gets its own slot of the interval
+	slot := time.Minute / 61
+	for i, user := range users[:60] {
+		offset := s.next[user.Key()].Sub(now)
+		if offset < slot*time.Duration(i) || offset >= slot*time.Duration(i+1) {
+			t.Fatalf("Expected first poll of %s in slot %d, got %s", user.Name, i, offset)
+		}
+	}
+
+	if offset := s.next[users[60].Key()].Sub(now); offset >= 10*time.Minute {
+		t.Errorf("Expected first poll of the dormant user within its interval, got %s", offset)
+	}
+
+	// Everyone is due once a whole interval has passed, and then not again
+	// until their own interval has
+	later := now.Add(time.Minute)
+	if due := s.due(users[:60], later); len(due) != 60 {
+		t.Errorf("Expected 60 users due, got %d", len(due))
+	}
+	for _, user := range users[:60] {
+		if next := s.next[user.Key()]; !next.After(later) || next.After(later.Add(time.Minute)) {
+			t.Fatalf("Expected %s to be due again within a minute, got %s", user.Name, next.Sub(later))
+		}
+	}
+
+	// Removed users are forgotten
+	s.plan(users[:1], later)
+	if len(s.next) != 1 {
+		t.Errorf("Expected 1 scheduled user, got %d", len(s.next))
+	}
+}
+
+func TestScheduler_DoneAfterRemoval(t *testing.T) {
+	user := config.User{Name: "bot", Token: "token"}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+	s := newScheduler(c, time.Minute)
+
+	now := time.Now()
+	s.plan([]config.User{user}, now)
+	if n := testutil.CollectAndCount(c, "github_rate_limit_poll_interval_seconds"); n != 1 {
+		t.Fatalf("Expected 1 poll interval series, got %d", n)
+	}
+
+	// A reload removes the user while it's being fetched
+	s.due([]config.User{user}, now.Add(time.Minute))
+	if err := c.Reload(&config.Config{}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	s.done(user, now.Add(time.Minute))
+
+	if n := testutil.CollectAndCount(c, "github_rate_limit_poll_interval_seconds"); n != 0 {
+		t.Errorf("Expected no poll interval series for a removed user, got %d", n)
+	}
+}
+
+func TestCollector_UpdateWorkers(t *testing.T) {
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/rate_limit" {
+			w.Write([]byte(`{"login": "octo-bot"}`))
+			return
+		}
+		mu.Lock()
+		running++
+		maxSeen = max(maxSeen, running)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.Write([]byte(rateLimitResponse))
+	}))
+	defer server.Close()
+
+	var users []config.User
+	for i := range 12 {
+		users = append(users, config.User{Name: fmt.Sprintf("bot-%d", i), Token: "token", BaseURL: server.URL})
+	}
+	c, err := NewCollector(&config.Config{Users: users, MetricLayout: config.MetricLayoutResource, PollWorkers: 3})
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	c.Update(context.Background())
+
+	if maxSeen > 3 {
+		t.Errorf("Expected at most 3 concurrent fetches, got %d", maxSeen)
+	}
+	if n := len(c.lastUpdate); n != 12 {
+		t.Errorf("Expected all 12 users fetched, got %d", n)
+	}
+}
+
+func TestCollector_AdaptInterval(t *testing.T) {
+	user := config.User{Name: "bot", Token: "token"}
+	c := newTestCollector(t, config.MetricLayoutResource, user)
+	base := time.Minute
+	now := time.Now()
+	reset := now.Add(time.Hour)
+
+	if d := c.adaptInterval(user, base, base, now); d != base {
+		t.Errorf("Expected the base interval without adaptive polling, got %s", d)
+	}
+
+	c.adaptive = &config.AdaptivePolling{
+		MinInterval:       10,
+		MaxInterval:       600,
+		Thresholds:        []config.Threshold{{Remaining: 0.25, Interval: 30}, {Remaining: 0.1, Interval: 10}},
+		ExhaustionHorizon: 900,
+	}
+	observe := func(remaining int, at time.Time) {
+		c.quotas[user.Key()] = map[string]Quota{"core": {Limit: 5000, Remaining: remaining, Used: 5000 - remaining, Reset: reset}}
+		r := rate{Limit: 5000, Remaining: remaining, Used: 5000 - remaining, Reset: reset.Unix()}
+		c.burnRate.observe(user.Key(), []string{user.Name, user.Host()}, "core", r, at)
+	}
+
+	// Nothing consumed: back off, up to the maximum
+	observe(4000, now.Add(-2*time.Minute))
+	observe(4000, now)
+	if d := c.adaptInterval(user, base, base, now); d != 2*time.Minute {
+		t.Errorf("Expected an idle user's interval to double, got %s", d)
+	}
+	if d := c.adaptInterval(user, base, 8*time.Minute, now); d != 10*time.Minute {
+		t.Errorf("Expected the interval capped at max_interval, got %s", d)
+	}
+
+	// Buckets that weren't used in their window are idle from the first poll,
+	// whatever other buckets the user doesn't export
+	c.burnRate.forget(user.Key())
+	search := config.User{Name: "bot", Token: "token", Resources: []string{"search"}}
+	c.quotas[user.Key()] = map[string]Quota{
+		"search": {Limit: 30, Remaining: 30, Reset: now.Add(time.Minute)},
+		"core":   {Limit: 5000, Remaining: 100, Used: 4900, Reset: reset},
+	}
+	c.burnRate.observe(user.Key(), []string{user.Name, user.Host()}, "search", rate{Limit: 30, Remaining: 30, Reset: now.Add(time.Minute).Unix()}, now)
+	if d := c.adaptInterval(search, base, base, now); d != 2*time.Minute {
+		t.Errorf("Expected an unused bucket to count as idle, got %s", d)
+	}
+
+	// Slow consumption with a fifth left hits the first threshold
+	c.burnRate.forget(user.Key())
+	observe(1000, now.Add(-2*time.Minute))
+	observe(999, now)
+	if d := c.adaptInterval(user, base, 8*time.Minute, now); d != 30*time.Second {
+		t.Errorf("Expected the threshold interval, got %s", d)
+	}
+
+	// Running out within the horizon polls as often as allowed
+	c.burnRate.forget(user.Key())
+	observe(1000, now.Add(-time.Minute))
+	observe(400, now)
+	if d := c.adaptInterval(user, base, base, now); d != 10*time.Second {
+		t.Errorf("Expected min_interval close to exhaustion, got %s", d)
+	}
+
+	// A bucket past its reset is full again
+	if d := c.adaptInterval(user, base, 10*time.Second, reset.Add(time.Second)); d != base {
+		t.Errorf("Expected the base interval after the reset, got %s", d)
+	}
+}
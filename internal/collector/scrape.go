@@ -0,0 +1,52 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scrapeCache lets concurrent scrapes, e.g. from an HA Prometheus pair, share
+// a single fetch, and serves recent results without fetching again
+type scrapeCache struct {
+	timeout time.Duration
+	ttl     time.Duration
+
+	lastFetch time.Time
+	// inflight is closed when the running fetch completes, nil when idle
+	inflight chan struct{}
+
+	mu sync.Mutex
+}
+
+// refresh fetches rate limits unless the cached ones are still fresh. Callers
+// arriving while a fetch is running wait for it instead of starting another.
+func (c *Collector) refresh() {
+	s := c.scrape
+
+	s.mu.Lock()
+	if time.Since(s.lastFetch) < s.ttl {
+		s.mu.Unlock()
+		return
+	}
+	if s.inflight != nil {
+		done := s.inflight
+		s.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	s.inflight = done
+	timeout := s.timeout
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c.Update(ctx)
+
+	s.mu.Lock()
+	s.lastFetch = time.Now()
+	s.inflight = nil
+	s.mu.Unlock()
+	close(done)
+}
@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// defaultSecondaryRetryAfter is how long GitHub asks to wait after a secondary
+// rate limit that comes without a Retry-After header
+const defaultSecondaryRetryAfter = time.Minute
+
+// secondaryLimitMetrics tracks responses blocked by GitHub's secondary rate
+// limits, which aren't part of the buckets /rate_limit reports
+type secondaryLimitMetrics struct {
+	hits       *prometheus.CounterVec
+	retryAfter *prometheus.GaugeVec
+}
+
+func newSecondaryLimitMetrics(custom []string) *secondaryLimitMetrics {
+	labels := metricLabels(custom)
+
+	return &secondaryLimitMetrics{
+		hits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "github_secondary_rate_limit_hits_total",
+				Help: "Total number of responses blocked by a secondary rate limit",
+			},
+			labels,
+		),
+		retryAfter: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_secondary_rate_limit_retry_after_seconds",
+				Help: "Seconds GitHub asked to wait after the last secondary rate limit hit",
+			},
+			labels,
+		),
+	}
+}
+
+func (m *secondaryLimitMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.hits.Describe(ch)
+	m.retryAfter.Describe(ch)
+}
+
+func (m *secondaryLimitMetrics) collect(ch chan<- prometheus.Metric) {
+	m.hits.Collect(ch)
+	m.retryAfter.Collect(ch)
+}
+
+func (m *secondaryLimitMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.hits.DeletePartialMatch(labels)
+	m.retryAfter.DeletePartialMatch(labels)
+}
+
+func (m *secondaryLimitMetrics) observe(labels []string, retryAfter time.Duration) {
+	m.hits.WithLabelValues(labels...).Inc()
+	m.retryAfter.WithLabelValues(labels...).Set(retryAfter.Seconds())
+}
+
+// SecondaryLimit tells whether a GitHub API response was blocked by a
+// secondary rate limit, and how long GitHub asked to wait. The response body
+// stays readable.
+func SecondaryLimit(resp *http.Response) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// An exhausted primary bucket also answers 429
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			return 0, false
+		}
+		return retryAfter(resp.Header), true
+	case http.StatusForbidden:
+		// Only the body tells a secondary limit apart from missing permissions
+		var abuseErr *github.AbuseRateLimitError
+		if !errors.As(github.CheckResponse(resp), &abuseErr) {
+			return 0, false
+		}
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, true
+		}
+		return defaultSecondaryRetryAfter, true
+	}
+
+	return 0, false
+}
+
+// retryAfter reads the Retry-After header GitHub sends with secondary limits
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return defaultSecondaryRetryAfter
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ObserveSecondaryLimit records a response made with the credentials of a
+// user that was blocked by a secondary rate limit
+func (c *Collector) ObserveSecondaryLimit(user config.User, retryAfter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Only users that are polled have series to update
+	if _, ok := c.clients[user.Key()]; !ok {
+		return
+	}
+
+	c.secondary.observe(c.userLabels(user), retryAfter)
+}
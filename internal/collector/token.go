@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+const (
+	headerOAuthScopes     = "X-OAuth-Scopes"
+	headerTokenExpiration = "GitHub-Authentication-Token-Expiration"
+)
+
+// tokenExpirationLayouts are the formats GitHub uses for the token expiration header
+var tokenExpirationLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05 -0700",
+}
+
+// tokenPrefixes maps token prefixes to token types
+// (https://github.blog/2021-04-05-behind-githubs-new-authentication-token-formats/)
+var tokenPrefixes = []struct {
+	prefix    string
+	tokenType string
+}{
+	{prefix: "github_pat_", tokenType: "fine_grained"},
+	{prefix: "ghp_", tokenType: "classic"},
+	{prefix: "gho_", tokenType: "oauth"},
+	{prefix: "ghu_", tokenType: "user_to_server"},
+	{prefix: "ghs_", tokenType: "installation"},
+}
+
+// tokenMetrics describes the tokens used to fetch rate limits
+type tokenMetrics struct {
+	expiry *prometheus.GaugeVec
+	info   *prometheus.GaugeVec
+}
+
+func newTokenMetrics(custom []string) *tokenMetrics {
+	return &tokenMetrics{
+		expiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_token_expiry_timestamp_seconds",
+				Help: "Expiration timestamp of the user's token, for tokens that expire",
+			},
+			metricLabels(custom),
+		),
+		info: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "github_token_info",
+				Help: "Information about the user's token, always 1",
+			},
+			metricLabels(custom, "login", "token_type", "scopes"),
+		),
+	}
+}
+
+func (m *tokenMetrics) describe(ch chan<- *prometheus.Desc) {
+	m.expiry.Describe(ch)
+	m.info.Describe(ch)
+}
+
+func (m *tokenMetrics) collect(ch chan<- prometheus.Metric) {
+	m.expiry.Collect(ch)
+	m.info.Collect(ch)
+}
+
+func (m *tokenMetrics) deletePartialMatch(labels prometheus.Labels) {
+	m.expiry.DeletePartialMatch(labels)
+	m.info.DeletePartialMatch(labels)
+}
+
+// set records token metadata from a rate limit response. values are the
+// user's label values.
+func (m *tokenMetrics) set(user config.User, values []string, login string, resp *http.Response) {
+	labels := prometheus.Labels{"user": user.Name, "host": user.Host()}
+
+	// Replace the previous info series, its labels may have changed
+	m.info.DeletePartialMatch(labels)
+	m.info.WithLabelValues(append(values, login, tokenType(user), scopes(resp.Header))...).Set(1)
+
+	if expiry, ok := tokenExpiration(resp.Header); ok {
+		m.expiry.WithLabelValues(values...).Set(float64(expiry.Unix()))
+	} else {
+		m.expiry.DeletePartialMatch(labels)
+	}
+}
+
+// tokenType guesses the kind of token from its prefix
+func tokenType(user config.User) string {
+	if user.IsApp() {
+		return "installation"
+	}
+	for _, p := range tokenPrefixes {
+		if strings.HasPrefix(user.Token, p.prefix) {
+			return p.tokenType
+		}
+	}
+	return "unknown"
+}
+
+// scopes returns the sorted, comma separated OAuth scopes of a classic token
+func scopes(header http.Header) string {
+	raw := header.Get(headerOAuthScopes)
+	if raw == "" {
+		return ""
+	}
+
+	var list []string
+	for _, scope := range strings.Split(raw, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			list = append(list, scope)
+		}
+	}
+	sort.Strings(list)
+
+	return strings.Join(list, ",")
+}
+
+// tokenExpiration parses the expiration header sent for expiring tokens
+func tokenExpiration(header http.Header) (time.Time, bool) {
+	raw := header.Get(headerTokenExpiration)
+	if raw == "" {
+		return time.Time{}, false
+	}
+
+	for _, layout := range tokenExpirationLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -14,19 +18,278 @@ import (
 // User represents a GitHub user to monitor
 type User struct {
 	Name  string `yaml:"name" toml:"name" hcl:"name"`
-	Token string `yaml:"token" toml:"token" hcl:"token"`
+	Token string `yaml:"token,omitempty" toml:"token,omitempty" hcl:"token,optional"`
+
+	// Alternatives to an inline Token, resolved into Token by LoadConfig
+	TokenEnv  string `yaml:"token_env,omitempty" toml:"token_env,omitempty" hcl:"token_env,optional"`
+	TokenFile string `yaml:"token_file,omitempty" toml:"token_file,omitempty" hcl:"token_file,optional"`
+
+	// GitHub App installation credentials, used instead of Token
+	AppID          int64  `yaml:"app_id,omitempty" toml:"app_id,omitempty" hcl:"app_id,optional"`
+	InstallationID int64  `yaml:"installation_id,omitempty" toml:"installation_id,omitempty" hcl:"installation_id,optional"`
+	PrivateKeyPath string `yaml:"private_key_path,omitempty" toml:"private_key_path,omitempty" hcl:"private_key_path,optional"`
+	// PrivateKey holds the contents of PrivateKeyPath, read by LoadConfig so a
+	// key rotated in place is a change of credentials
+	PrivateKey []byte `yaml:"-" toml:"-"`
+
+	// GitHub Enterprise Server API endpoints (default: api.github.com)
+	BaseURL   string `yaml:"base_url,omitempty" toml:"base_url,omitempty" hcl:"base_url,optional"`
+	UploadURL string `yaml:"upload_url,omitempty" toml:"upload_url,omitempty" hcl:"upload_url,optional"`
+
+	// PollInterval overrides the global poll interval for the user, in seconds
+	PollInterval int `yaml:"poll_interval,omitempty" toml:"poll_interval,omitempty" hcl:"poll_interval,optional"`
+	// Resources limits the exported rate limit buckets, all when empty
+	Resources []string `yaml:"resources,omitempty" toml:"resources,omitempty" hcl:"resources,optional"`
+	// Labels are added to every metric of the user
+	Labels map[string]string `yaml:"labels,omitempty" toml:"labels,omitempty" hcl:"labels,optional"`
+}
+
+// DefaultHost is the API host used by users without a base URL
+const DefaultHost = "api.github.com"
+
+// IsEnterprise reports whether the user targets a GitHub Enterprise Server instance
+func (u User) IsEnterprise() bool {
+	return u.BaseURL != ""
+}
+
+// Host returns the API host the user's token belongs to
+func (u User) Host() string {
+	if u.BaseURL == "" {
+		return DefaultHost
+	}
+	parsed, err := url.Parse(u.BaseURL)
+	if err != nil || parsed.Hostname() == "" {
+		return u.BaseURL
+	}
+	return parsed.Hostname()
+}
+
+// Key uniquely identifies a user across GitHub hosts
+func (u User) Key() string {
+	return u.Host() + "/" + u.Name
+}
+
+// Interval returns how often the user is polled, given the global poll interval in seconds
+func (u User) Interval(global int) int {
+	if u.PollInterval > 0 {
+		return u.PollInterval
+	}
+	return global
+}
+
+// ExportsResource reports whether a rate limit bucket is exported for the user
+func (u User) ExportsResource(name string) bool {
+	return len(u.Resources) == 0 || slices.Contains(u.Resources, name)
+}
+
+// LabelNames returns the sorted names of the user's custom labels
+func (u User) LabelNames() []string {
+	names := make([]string, 0, len(u.Labels))
+	for name := range u.Labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// IsApp reports whether the user authenticates as a GitHub App installation
+func (u User) IsApp() bool {
+	return u.AppID != 0 || u.InstallationID != 0 || u.PrivateKeyPath != ""
 }
 
 // Config represents the application configuration
 type Config struct {
-	Users      []User `yaml:"users" toml:"users" hcl:"user,block"`
+	Users        []User `yaml:"users" toml:"users" hcl:"user,block"`
+	Modules      []User `yaml:"modules,omitempty" toml:"modules,omitempty" hcl:"module,block"`
+	ListenAddr   string `yaml:"listen_addr,omitempty" toml:"listen_addr,omitempty" hcl:"listen_addr,optional"`
+	MetricsPath  string `yaml:"metrics_path,omitempty" toml:"metrics_path,omitempty" hcl:"metrics_path,optional"`
+	PollInterval int    `yaml:"poll_interval,omitempty" toml:"poll_interval,omitempty" hcl:"poll_interval,optional"`
+	MetricLayout string `yaml:"metric_layout,omitempty" toml:"metric_layout,omitempty" hcl:"metric_layout,optional"`
+	StaleAfter   int    `yaml:"stale_after,omitempty" toml:"stale_after,omitempty" hcl:"stale_after,optional"`
+	// PollWorkers bounds how many users are fetched at the same time
+	PollWorkers int `yaml:"poll_workers,omitempty" toml:"poll_workers,omitempty" hcl:"poll_workers,optional"`
+
+	// Fetch on scrape instead of polling in the background
+	CollectionMode string `yaml:"collection_mode,omitempty" toml:"collection_mode,omitempty" hcl:"collection_mode,optional"`
+	ScrapeTimeout  int    `yaml:"scrape_timeout,omitempty" toml:"scrape_timeout,omitempty" hcl:"scrape_timeout,optional"`
+	ScrapeCacheTTL int    `yaml:"scrape_cache_ttl,omitempty" toml:"scrape_cache_ttl,omitempty" hcl:"scrape_cache_ttl,optional"`
+
+	Broker *Broker `yaml:"broker,omitempty" toml:"broker,omitempty" hcl:"broker,block"`
+	Proxy  *Proxy  `yaml:"proxy,omitempty" toml:"proxy,omitempty" hcl:"proxy,block"`
+	Ingest *Ingest `yaml:"ingest,omitempty" toml:"ingest,omitempty" hcl:"ingest,block"`
+
+	AdaptivePolling *AdaptivePolling `yaml:"adaptive_polling,omitempty" toml:"adaptive_polling,omitempty" hcl:"adaptive_polling,block"`
+
+	// Groups are pools of users whose rate limits are also exported in aggregate
+	Groups []Group `yaml:"groups,omitempty" toml:"groups,omitempty" hcl:"group,block"`
+
+	Alerting *Alerting `yaml:"alerting,omitempty" toml:"alerting,omitempty" hcl:"alerting,block"`
+
+	// PrometheusRules configures the alert rules printed by the rules
+	// subcommand, always set after loading
+	PrometheusRules *PrometheusRules `yaml:"prometheus_rules,omitempty" toml:"prometheus_rules,omitempty" hcl:"prometheus_rules,block"`
+}
+
+// PrometheusRules configures generated Prometheus alert rules, which fire when
+// the remaining share of a bucket drops below a percentage of its limit
+type PrometheusRules struct {
+	WarningPercent  float64 `yaml:"warning_percent,omitempty" toml:"warning_percent,omitempty" hcl:"warning_percent,optional"`
+	CriticalPercent float64 `yaml:"critical_percent,omitempty" toml:"critical_percent,omitempty" hcl:"critical_percent,optional"`
+	// For is how long a threshold has to be crossed before the alert fires, in seconds
+	For int `yaml:"for,omitempty" toml:"for,omitempty" hcl:"for,optional"`
+	// Resources override the thresholds of single buckets
+	Resources []RuleThresholds `yaml:"resources,omitempty" toml:"resources,omitempty" hcl:"resource,block"`
+	// Overrides override the thresholds of single users, for every bucket
+	// unless a resource is set
+	Overrides []RuleThresholds `yaml:"overrides,omitempty" toml:"overrides,omitempty" hcl:"override,block"`
+}
+
+// RuleThresholds override the generated thresholds, unset values are inherited
+type RuleThresholds struct {
+	// User is a user name, or host/name for a name used on several hosts
+	User            string  `yaml:"user,omitempty" toml:"user,omitempty" hcl:"user,optional"`
+	Resource        string  `yaml:"resource,omitempty" toml:"resource,omitempty" hcl:"resource,optional"`
+	WarningPercent  float64 `yaml:"warning_percent,omitempty" toml:"warning_percent,omitempty" hcl:"warning_percent,optional"`
+	CriticalPercent float64 `yaml:"critical_percent,omitempty" toml:"critical_percent,omitempty" hcl:"critical_percent,optional"`
+	For             int     `yaml:"for,omitempty" toml:"for,omitempty" hcl:"for,optional"`
+}
+
+// Alerting configures rules the exporter evaluates itself, notifying webhooks
+// when they fire and resolve
+type Alerting struct {
+	Rules    []AlertRule `yaml:"rules" toml:"rules" hcl:"rule,block"`
+	Webhooks []Webhook   `yaml:"webhooks" toml:"webhooks" hcl:"webhook,block"`
+	// MaxRetries bounds how often a failed notification is retried
+	MaxRetries int `yaml:"max_retries,omitempty" toml:"max_retries,omitempty" hcl:"max_retries,optional"`
+	// QueueSize bounds the notifications waiting per webhook, the oldest are
+	// dropped when it's full
+	QueueSize int `yaml:"queue_size,omitempty" toml:"queue_size,omitempty" hcl:"queue_size,optional"`
+}
+
+// AlertRule fires while an account or group runs low on a bucket
+type AlertRule struct {
+	Name string `yaml:"name" toml:"name" hcl:"name"`
+	// User or Group selects what the rule watches, every user when neither is
+	// set. User is a user name, or host/name for a name used on several hosts.
+	User     string `yaml:"user,omitempty" toml:"user,omitempty" hcl:"user,optional"`
+	Group    string `yaml:"group,omitempty" toml:"group,omitempty" hcl:"group,optional"`
+	Resource string `yaml:"resource,omitempty" toml:"resource,omitempty" hcl:"resource,optional"`
+	// The rule fires when the remaining requests drop below RemainingBelow, or
+	// below RemainingBelowPercent of the limit
+	RemainingBelow        int     `yaml:"remaining_below,omitempty" toml:"remaining_below,omitempty" hcl:"remaining_below,optional"`
+	RemainingBelowPercent float64 `yaml:"remaining_below_percent,omitempty" toml:"remaining_below_percent,omitempty" hcl:"remaining_below_percent,optional"`
+	// For is how long the condition has to hold before the rule fires, in seconds
+	For int `yaml:"for,omitempty" toml:"for,omitempty" hcl:"for,optional"`
+}
+
+// Matches reports whether the rule watches a user on its own
+func (r AlertRule) Matches(user User) bool {
+	if r.Group != "" {
+		return false
+	}
+	return r.User == "" || r.User == user.Name || r.User == user.Key()
+}
+
+// Webhook is an endpoint alert notifications are POSTed to
+type Webhook struct {
+	URL string `yaml:"url" toml:"url" hcl:"url"`
+	// Headers are sent with every notification, e.g. for authentication
+	Headers map[string]string `yaml:"headers,omitempty" toml:"headers,omitempty" hcl:"headers,optional"`
+}
+
+// Group is a named pool of users used interchangeably
+type Group struct {
+	Name string `yaml:"name" toml:"name" hcl:"name"`
+	// Users are the names of the members, or host/name for a name used on
+	// several hosts
+	Users []string `yaml:"users" toml:"users" hcl:"users"`
+}
+
+// Includes reports whether a user is a member of the group
+func (g Group) Includes(user User) bool {
+	return slices.Contains(g.Users, user.Name) || slices.Contains(g.Users, user.Key())
+}
+
+// AdaptivePolling configures poll intervals that follow how much quota is left
+type AdaptivePolling struct {
+	// MinInterval and MaxInterval bound the poll interval, in seconds
+	MinInterval int `yaml:"min_interval,omitempty" toml:"min_interval,omitempty" hcl:"min_interval,optional"`
+	MaxInterval int `yaml:"max_interval,omitempty" toml:"max_interval,omitempty" hcl:"max_interval,optional"`
+	// Thresholds shorten the interval as buckets run low
+	Thresholds []Threshold `yaml:"thresholds,omitempty" toml:"thresholds,omitempty" hcl:"threshold,block"`
+	// ExhaustionHorizon polls at MinInterval when a bucket is projected to run
+	// out within this many seconds
+	ExhaustionHorizon int `yaml:"exhaustion_horizon,omitempty" toml:"exhaustion_horizon,omitempty" hcl:"exhaustion_horizon,optional"`
+}
+
+// Threshold is the poll interval used once a bucket's remaining share drops to Remaining
+type Threshold struct {
+	// Remaining is the share of the limit left, between 0 and 1
+	Remaining float64 `yaml:"remaining" toml:"remaining" hcl:"remaining"`
+	// Interval is the poll interval in seconds
+	Interval int `yaml:"interval" toml:"interval" hcl:"interval"`
+}
+
+// Ingest configures the endpoint clients report rate limits they've seen to
+type Ingest struct {
+	// APITokens are the bearer tokens callers authenticate with
+	APITokens []string `yaml:"api_tokens" toml:"api_tokens" hcl:"api_tokens"`
+}
+
+// Proxy configures the GitHub API reverse proxy, which makes requests with
+// the credentials of a user and records the rate limits of the responses
+type Proxy struct {
+	// ListenAddr is the address of the proxy listener
 	ListenAddr string `yaml:"listen_addr,omitempty" toml:"listen_addr,omitempty" hcl:"listen_addr,optional"`
-	MetricsPath string `yaml:"metrics_path,omitempty" toml:"metrics_path,omitempty" hcl:"metrics_path,optional"`
-	PollInterval int   `yaml:"poll_interval,omitempty" toml:"poll_interval,omitempty" hcl:"poll_interval,optional"`
+	// APITokens are the bearer tokens callers authenticate with
+	APITokens []string `yaml:"api_tokens" toml:"api_tokens" hcl:"api_tokens"`
+}
+
+// Broker configures the token broker API, which hands out the account with
+// the most remaining quota
+type Broker struct {
+	// APITokens are the bearer tokens callers authenticate with
+	APITokens []string `yaml:"api_tokens" toml:"api_tokens" hcl:"api_tokens"`
+	// RevealTokens allows callers to ask for the GitHub token of the account
+	RevealTokens bool `yaml:"reveal_tokens,omitempty" toml:"reveal_tokens,omitempty" hcl:"reveal_tokens,optional"`
+	// LeaseTTL is how long a lease holds its requests, in seconds
+	LeaseTTL int `yaml:"lease_ttl,omitempty" toml:"lease_ttl,omitempty" hcl:"lease_ttl,optional"`
+	// LeaseCost is the number of requests a lease holds unless the caller asks for another amount
+	LeaseCost int `yaml:"lease_cost,omitempty" toml:"lease_cost,omitempty" hcl:"lease_cost,optional"`
 }
 
+// Metric layouts
+const (
+	// MetricLayoutLegacy exports one metric family per bucket, e.g. github_rate_limit_core_remaining
+	MetricLayoutLegacy = "legacy"
+	// MetricLayoutResource exports single families with a resource label, e.g. github_rate_limit_remaining{resource="core"}
+	MetricLayoutResource = "resource"
+	// MetricLayoutBoth exports both layouts side by side, to ease migration
+	MetricLayoutBoth = "both"
+)
+
+// Collection modes
+const (
+	// CollectionModePoll fetches rate limits in the background every poll_interval
+	CollectionModePoll = "poll"
+	// CollectionModeScrape fetches rate limits when Prometheus scrapes the exporter
+	CollectionModeScrape = "scrape"
+)
+
 // LoadConfig loads configuration from a file (YAML, TOML, or HCL based on extension)
 func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, true)
+}
+
+// LoadConfigWithoutCredentials loads configuration like LoadConfig, without
+// reading tokens or private keys. Environment variables that aren't set are
+// left unexpanded. It serves commands that only need the accounts, e.g.
+// generating alert rules where the secrets aren't available.
+func LoadConfigWithoutCredentials(path string) (*Config, error) {
+	return loadConfig(path, false)
+}
+
+func loadConfig(path string, credentials bool) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -34,6 +297,15 @@ func LoadConfig(path string) (*Config, error) {
 
 	ext := strings.ToLower(filepath.Ext(path))
 
+	data, missing := expandEnv(data)
+	switch {
+	case len(missing) > 0 && credentials:
+		return nil, fmt.Errorf("environment variables referenced in config file are not set: %s", strings.Join(missing, ", "))
+	case len(missing) > 0 && ext == ".hcl":
+		// Keep HCL from taking the references for template interpolations
+		data = envPattern.ReplaceAll(data, []byte("$$$0"))
+	}
+
 	var cfg Config
 
 	switch ext {
@@ -61,20 +333,565 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.PollInterval == 0 {
 		cfg.PollInterval = 60 // Default to 60 seconds
 	}
+	if cfg.PollWorkers == 0 {
+		cfg.PollWorkers = 10
+	}
+	if cfg.MetricLayout == "" {
+		cfg.MetricLayout = MetricLayoutLegacy
+	}
+	if cfg.CollectionMode == "" {
+		cfg.CollectionMode = CollectionModePoll
+	}
+	if cfg.ScrapeTimeout == 0 {
+		cfg.ScrapeTimeout = 10
+	}
+	if cfg.ScrapeCacheTTL == 0 {
+		cfg.ScrapeCacheTTL = 5
+	}
+
+	if cfg.Broker != nil {
+		if cfg.Broker.LeaseTTL == 0 {
+			cfg.Broker.LeaseTTL = 300
+		}
+		if cfg.Broker.LeaseCost == 0 {
+			cfg.Broker.LeaseCost = 100
+		}
+	}
+
+	if a := cfg.AdaptivePolling; a != nil {
+		if a.MinInterval == 0 {
+			a.MinInterval = 10
+		}
+		if a.MaxInterval == 0 {
+			a.MaxInterval = 600
+		}
+		if a.Thresholds == nil {
+			a.Thresholds = []Threshold{{Remaining: 0.25, Interval: 30}, {Remaining: 0.1, Interval: 10}}
+		}
+		if a.ExhaustionHorizon == 0 {
+			a.ExhaustionHorizon = 900
+		}
+	}
+
+	if a := cfg.Alerting; a != nil {
+		if a.MaxRetries == 0 {
+			a.MaxRetries = 5
+		}
+		if a.QueueSize == 0 {
+			a.QueueSize = 100
+		}
+		for i := range a.Rules {
+			if a.Rules[i].Resource == "" {
+				a.Rules[i].Resource = "core"
+			}
+		}
+	}
+
+	// The rules subcommand works without a prometheus_rules section
+	if cfg.PrometheusRules == nil {
+		cfg.PrometheusRules = &PrometheusRules{}
+	}
+	if cfg.PrometheusRules.WarningPercent == 0 {
+		cfg.PrometheusRules.WarningPercent = 20
+	}
+	if cfg.PrometheusRules.CriticalPercent == 0 {
+		cfg.PrometheusRules.CriticalPercent = 5
+	}
+	if cfg.PrometheusRules.For == 0 {
+		cfg.PrometheusRules.For = 300
+	}
+
+	if cfg.Proxy != nil && cfg.Proxy.ListenAddr == "" {
+		cfg.Proxy.ListenAddr = ":9102"
+	}
 
 	// Validate
-	if len(cfg.Users) == 0 {
+	switch cfg.MetricLayout {
+	case MetricLayoutLegacy, MetricLayoutResource, MetricLayoutBoth:
+	default:
+		return nil, fmt.Errorf("unsupported metric_layout: %s (supported: %s, %s, %s)",
+			cfg.MetricLayout, MetricLayoutLegacy, MetricLayoutResource, MetricLayoutBoth)
+	}
+
+	switch cfg.CollectionMode {
+	case CollectionModePoll, CollectionModeScrape:
+	default:
+		return nil, fmt.Errorf("unsupported collection_mode: %s (supported: %s, %s)",
+			cfg.CollectionMode, CollectionModePoll, CollectionModeScrape)
+	}
+
+	if cfg.ScrapeTimeout < 0 {
+		return nil, fmt.Errorf("scrape_timeout must not be negative")
+	}
+	if cfg.ScrapeCacheTTL < 0 {
+		return nil, fmt.Errorf("scrape_cache_ttl must not be negative")
+	}
+
+	if cfg.PollWorkers < 0 {
+		return nil, fmt.Errorf("poll_workers must not be negative")
+	}
+
+	if cfg.StaleAfter < 0 {
+		return nil, fmt.Errorf("stale_after must not be negative")
+	}
+	if cfg.StaleAfter > 0 && cfg.StaleAfter < cfg.PollInterval {
+		return nil, fmt.Errorf("stale_after (%d) must not be shorter than poll_interval (%d)", cfg.StaleAfter, cfg.PollInterval)
+	}
+
+	if cfg.AdaptivePolling != nil {
+		if err := validateAdaptivePolling(cfg.AdaptivePolling); err != nil {
+			return nil, err
+		}
+		if cfg.StaleAfter > 0 && cfg.StaleAfter < cfg.AdaptivePolling.MaxInterval {
+			return nil, fmt.Errorf("stale_after (%d) must not be shorter than adaptive_polling max_interval (%d)", cfg.StaleAfter, cfg.AdaptivePolling.MaxInterval)
+		}
+	}
+
+	if cfg.Broker != nil {
+		if err := validateBroker(cfg.Broker); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Proxy != nil {
+		if err := validateAPITokens("proxy", cfg.Proxy.APITokens); err != nil {
+			return nil, err
+		}
+		if cfg.Proxy.ListenAddr == cfg.ListenAddr {
+			return nil, fmt.Errorf("proxy listen_addr must differ from listen_addr")
+		}
+	}
+
+	if cfg.Ingest != nil {
+		if err := validateAPITokens("ingest", cfg.Ingest.APITokens); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Users) == 0 && len(cfg.Modules) == 0 {
 		return nil, fmt.Errorf("no users defined in config")
 	}
 
-	for i, user := range cfg.Users {
-		if user.Name == "" {
-			return nil, fmt.Errorf("user at index %d has no name", i)
+	if err := validateUsers(cfg.Users, "user", credentials); err != nil {
+		return nil, err
+	}
+	if err := validateUsers(cfg.Modules, "module", credentials); err != nil {
+		return nil, err
+	}
+
+	if err := validateGroups(cfg.Groups, cfg.Users); err != nil {
+		return nil, err
+	}
+
+	if cfg.Alerting != nil {
+		if err := validateAlerting(cfg.Alerting, cfg.Users, cfg.Groups); err != nil {
+			return nil, err
 		}
-		if user.Token == "" {
-			return nil, fmt.Errorf("user %s has no token", user.Name)
+	}
+
+	if err := validatePrometheusRules(cfg.PrometheusRules, cfg.Users); err != nil {
+		return nil, err
+	}
+
+	for _, user := range cfg.Users {
+		if interval := user.Interval(cfg.PollInterval); cfg.StaleAfter > 0 && cfg.StaleAfter < interval {
+			return nil, fmt.Errorf("stale_after (%d) must not be shorter than the poll_interval (%d) of user %s", cfg.StaleAfter, interval, user.Name)
 		}
 	}
 
 	return &cfg, nil
 }
+
+// validateGroups checks that group names are unique and every member is
+// exactly one user
+func validateGroups(groups []Group, users []User) error {
+	seen := make(map[string]bool)
+	for i, group := range groups {
+		if group.Name == "" {
+			return fmt.Errorf("group at index %d has no name", i)
+		}
+		if seen[group.Name] {
+			return fmt.Errorf("duplicate group %s", group.Name)
+		}
+		seen[group.Name] = true
+
+		if len(group.Users) == 0 {
+			return fmt.Errorf("group %s has no users", group.Name)
+		}
+		members := make(map[string]bool)
+		for _, member := range group.Users {
+			key, err := resolveUser(member, users)
+			if err != nil {
+				return fmt.Errorf("group %s: %w", group.Name, err)
+			}
+			if members[key] {
+				return fmt.Errorf("group %s: duplicate user %q", group.Name, member)
+			}
+			members[key] = true
+		}
+	}
+	return nil
+}
+
+// resolveUser returns the key of the one user a name or host/name refers to
+func resolveUser(ref string, users []User) (string, error) {
+	var matches []string
+	for _, user := range users {
+		if ref == user.Name || ref == user.Key() {
+			matches = append(matches, user.Key())
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("unknown user %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("user %q exists on several hosts, use one of %s", ref, strings.Join(matches, ", "))
+	}
+}
+
+// validateAlerting checks that alert rules refer to existing users and groups
+// and that notifications have somewhere to go
+func validateAlerting(a *Alerting, users []User, groups []Group) error {
+	if len(a.Rules) == 0 {
+		return fmt.Errorf("alerting has no rules")
+	}
+	if len(a.Webhooks) == 0 {
+		return fmt.Errorf("alerting has no webhooks")
+	}
+	if a.MaxRetries < 0 || a.QueueSize < 0 {
+		return fmt.Errorf("alerting max_retries and queue_size must not be negative")
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range a.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("alert rule at index %d has no name", i)
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		switch {
+		case rule.User != "" && rule.Group != "":
+			return fmt.Errorf("alert rule %s: user and group are mutually exclusive", rule.Name)
+		case rule.User != "":
+			if _, err := resolveUser(rule.User, users); err != nil {
+				return fmt.Errorf("alert rule %s: %w", rule.Name, err)
+			}
+		case rule.Group != "":
+			if !slices.ContainsFunc(groups, func(g Group) bool { return g.Name == rule.Group }) {
+				return fmt.Errorf("alert rule %s: unknown group %q", rule.Name, rule.Group)
+			}
+		}
+
+		if (rule.RemainingBelow > 0) == (rule.RemainingBelowPercent > 0) {
+			return fmt.Errorf("alert rule %s: set either remaining_below or remaining_below_percent", rule.Name)
+		}
+		if rule.RemainingBelow < 0 || rule.RemainingBelowPercent < 0 || rule.RemainingBelowPercent > 100 {
+			return fmt.Errorf("alert rule %s: remaining_below must be positive and remaining_below_percent between 0 and 100", rule.Name)
+		}
+		if rule.For < 0 {
+			return fmt.Errorf("alert rule %s: for must not be negative", rule.Name)
+		}
+	}
+
+	for i, webhook := range a.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alerting webhook at index %d: url must be an absolute http or https URL", i)
+		}
+	}
+	return nil
+}
+
+// validatePrometheusRules checks that thresholds are percentages and that
+// every bucket and user is overridden at most once
+func validatePrometheusRules(r *PrometheusRules, users []User) error {
+	all := append([]RuleThresholds{{WarningPercent: r.WarningPercent, CriticalPercent: r.CriticalPercent, For: r.For}}, r.Resources...)
+	all = append(all, r.Overrides...)
+	for _, t := range all {
+		if t.WarningPercent < 0 || t.WarningPercent > 100 || t.CriticalPercent < 0 || t.CriticalPercent > 100 {
+			return fmt.Errorf("prometheus_rules: warning_percent and critical_percent must be between 0 and 100")
+		}
+		if t.For < 0 {
+			return fmt.Errorf("prometheus_rules: for must not be negative")
+		}
+	}
+
+	resources := make(map[string]bool)
+	for i, t := range r.Resources {
+		if t.Resource == "" || t.User != "" {
+			return fmt.Errorf("prometheus_rules resource at index %d: set resource and no user", i)
+		}
+		if resources[t.Resource] {
+			return fmt.Errorf("prometheus_rules: duplicate resource %s", t.Resource)
+		}
+		resources[t.Resource] = true
+	}
+
+	overrides := make(map[string]bool)
+	for i, t := range r.Overrides {
+		if t.User == "" {
+			return fmt.Errorf("prometheus_rules override at index %d has no user", i)
+		}
+		key, err := resolveUser(t.User, users)
+		if err != nil {
+			return fmt.Errorf("prometheus_rules override at index %d: %w", i, err)
+		}
+		key += "/" + t.Resource
+		if overrides[key] {
+			return fmt.Errorf("prometheus_rules: duplicate override of user %q", t.User)
+		}
+		overrides[key] = true
+	}
+	return nil
+}
+
+// validateAdaptivePolling checks that the interval bounds and thresholds make sense
+func validateAdaptivePolling(a *AdaptivePolling) error {
+	if a.MinInterval < 0 || a.ExhaustionHorizon < 0 {
+		return fmt.Errorf("adaptive_polling min_interval and exhaustion_horizon must not be negative")
+	}
+	if a.MaxInterval < a.MinInterval {
+		return fmt.Errorf("adaptive_polling max_interval (%d) must not be shorter than min_interval (%d)", a.MaxInterval, a.MinInterval)
+	}
+	for i, t := range a.Thresholds {
+		if t.Remaining <= 0 || t.Remaining > 1 {
+			return fmt.Errorf("adaptive_polling threshold at index %d: remaining must be between 0 and 1", i)
+		}
+		if t.Interval <= 0 {
+			return fmt.Errorf("adaptive_polling threshold at index %d: interval must be positive", i)
+		}
+	}
+	return nil
+}
+
+// validateBroker validates the token broker settings
+func validateBroker(broker *Broker) error {
+	if err := validateAPITokens("broker", broker.APITokens); err != nil {
+		return err
+	}
+	if broker.LeaseTTL < 0 {
+		return fmt.Errorf("broker lease_ttl must not be negative")
+	}
+	if broker.LeaseCost < 0 {
+		return fmt.Errorf("broker lease_cost must not be negative")
+	}
+	return nil
+}
+
+// validateAPITokens checks that an API can't be used without authentication
+func validateAPITokens(kind string, tokens []string) error {
+	if len(tokens) == 0 {
+		return fmt.Errorf("%s has no api_tokens", kind)
+	}
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("%s api token at index %d is empty", kind, i)
+		}
+	}
+	return nil
+}
+
+// validateUsers validates a list of users and resolves their tokens. kind
+// names the list in error messages.
+func validateUsers(users []User, kind string, credentials bool) error {
+	seen := make(map[string]bool)
+	for i := range users {
+		user := &users[i]
+		if user.Name == "" {
+			return fmt.Errorf("%s at index %d has no name", kind, i)
+		}
+		if err := validateCredentials(*user); err != nil {
+			return fmt.Errorf("invalid %s at index %d: %w", kind, i, err)
+		}
+		if credentials {
+			if err := resolveToken(user); err != nil {
+				return fmt.Errorf("invalid %s at index %d: %w", kind, i, err)
+			}
+		}
+		if err := validateURLs(*user); err != nil {
+			return fmt.Errorf("invalid %s at index %d: %w", kind, i, err)
+		}
+		if user.PollInterval < 0 {
+			return fmt.Errorf("invalid %s at index %d: poll_interval must not be negative", kind, i)
+		}
+		if slices.Contains(user.Resources, "") {
+			return fmt.Errorf("invalid %s at index %d: resources must not contain empty names", kind, i)
+		}
+		if err := validateLabels(user.Labels); err != nil {
+			return fmt.Errorf("invalid %s at index %d: %w", kind, i, err)
+		}
+		// Metric families have a fixed set of label names
+		if names, first := user.LabelNames(), users[0].LabelNames(); !slices.Equal(names, first) {
+			return fmt.Errorf("invalid %s at index %d: labels [%s] differ from the labels [%s] of %s %s",
+				kind, i, strings.Join(names, ", "), strings.Join(first, ", "), kind, users[0].Name)
+		}
+		if seen[user.Key()] {
+			return fmt.Errorf("duplicate %s %s on host %s", kind, user.Name, user.Host())
+		}
+		seen[user.Key()] = true
+	}
+	return nil
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are label names the exporter sets itself
+var reservedLabels = []string{"user", "host", "resource", "reason", "state", "login", "token_type", "scopes", "le"}
+
+// validateLabels checks that custom labels are valid and don't clash with the
+// exporter's own labels
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if slices.Contains(reservedLabels, name) {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// validateCredentials checks that a user has exactly one token source or a
+// complete set of GitHub App credentials
+func validateCredentials(user User) error {
+	sources := 0
+	for _, set := range []bool{user.Token != "", user.TokenEnv != "", user.TokenFile != "", user.IsApp()} {
+		if set {
+			sources++
+		}
+	}
+
+	switch {
+	case sources == 0:
+		return fmt.Errorf("user %s has no token (set one of token, token_env, token_file or GitHub App credentials)", user.Name)
+	case sources > 1:
+		return fmt.Errorf("user %s has more than one of token, token_env, token_file and GitHub App credentials", user.Name)
+	case !user.IsApp():
+		return nil
+	}
+
+	if user.AppID == 0 {
+		return fmt.Errorf("user %s has no app_id", user.Name)
+	}
+	if user.InstallationID == 0 {
+		return fmt.Errorf("user %s has no installation_id", user.Name)
+	}
+	if user.PrivateKeyPath == "" {
+		return fmt.Errorf("user %s has no private_key_path", user.Name)
+	}
+	return nil
+}
+
+// resolveToken reads a token referenced by token_env or token_file into Token,
+// and a GitHub App's private key into PrivateKey
+func resolveToken(user *User) error {
+	switch {
+	case user.TokenEnv != "":
+		token, ok := os.LookupEnv(user.TokenEnv)
+		if !ok || token == "" {
+			return fmt.Errorf("user %s: environment variable %s is not set", user.Name, user.TokenEnv)
+		}
+		user.Token = token
+	case user.TokenFile != "":
+		data, err := os.ReadFile(user.TokenFile)
+		if err != nil {
+			return fmt.Errorf("user %s: failed to read token file: %w", user.Name, err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("user %s: token file %s is empty", user.Name, user.TokenFile)
+		}
+		user.Token = token
+	case user.PrivateKeyPath != "":
+		data, err := os.ReadFile(user.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("user %s: failed to read private key: %w", user.Name, err)
+		}
+		user.PrivateKey = data
+	}
+	return nil
+}
+
+// envPattern matches ${VAR} references in the configuration file
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references with the value of the environment
+// variable, returning the variables that aren't set, whose references are
+// left as they are. Comments are left as they are too, so commented-out
+// settings don't need their variables.
+func expandEnv(data []byte) ([]byte, []string) {
+	var missing []string
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i, line := range lines {
+		end := commentStart(line)
+		expanded := envPattern.ReplaceAllFunc(line[:end], func(match []byte) []byte {
+			name := string(envPattern.FindSubmatch(match)[1])
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+				return match
+			}
+			return []byte(value)
+		})
+		lines[i] = append(expanded, line[end:]...)
+	}
+
+	return bytes.Join(lines, nil), missing
+}
+
+// commentStart returns the offset of the comment in a line, or its length if
+// it has none. Comments start with # or // outside quoted strings, at the
+// start of the line or after whitespace, which covers YAML, TOML and HCL.
+func commentStart(line []byte) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != 0 {
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		// Quotes only open a string where a value starts, so apostrophes in
+		// plain YAML scalars don't hide a comment
+		start := i == 0 || strings.IndexByte(" \t:=[{,", line[i-1]) >= 0
+		switch {
+		case (c == '"' || c == '\'') && start:
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return i
+		case c == '/' && i+1 < len(line) && line[i+1] == '/' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return i
+		}
+	}
+	return len(line)
+}
+
+// validateURLs checks that Enterprise Server endpoints are absolute URLs
+func validateURLs(user User) error {
+	if user.UploadURL != "" && user.BaseURL == "" {
+		return fmt.Errorf("user %s has an upload_url but no base_url", user.Name)
+	}
+	for _, raw := range []string{user.BaseURL, user.UploadURL} {
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("user %s has an invalid URL %q", user.Name, raw)
+		}
+	}
+	return nil
+}
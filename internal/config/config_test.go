@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -175,6 +177,14 @@ users:
 	if cfg.PollInterval != 60 {
 		t.Errorf("Expected default poll_interval 60, got %d", cfg.PollInterval)
 	}
+
+	if cfg.MetricLayout != MetricLayoutLegacy {
+		t.Errorf("Expected default metric_layout '%s', got '%s'", MetricLayoutLegacy, cfg.MetricLayout)
+	}
+
+	if cfg.CollectionMode != CollectionModePoll {
+		t.Errorf("Expected default collection_mode '%s', got '%s'", CollectionModePoll, cfg.CollectionMode)
+	}
 }
 
 func TestLoadConfig_NoUsers(t *testing.T) {
@@ -381,3 +391,1386 @@ users:
 		t.Errorf("Expected 1 user, got %d", len(cfg.Users))
 	}
 }
+
+// writeKeyFile writes a private key placeholder and returns its path
+func writeKeyFile(t *testing.T, content string) string {
+	t.Helper()
+
+	keyfile, err := os.CreateTemp("", "app-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(keyfile.Name()) })
+
+	if _, err := keyfile.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyfile.Name()
+}
+
+func TestLoadConfig_GitHubApp(t *testing.T) {
+	keyPath := writeKeyFile(t, "app key")
+	content := `
+users:
+  - name: "app-bot"
+    app_id: 12345
+    installation_id: 67890
+    private_key_path: "/etc/exporter/app.pem"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(strings.ReplaceAll(content, "/etc/exporter/app.pem", keyPath))); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	user := cfg.Users[0]
+	if !user.IsApp() {
+		t.Error("Expected user to be a GitHub App installation")
+	}
+
+	if user.AppID != 12345 {
+		t.Errorf("Expected app_id 12345, got %d", user.AppID)
+	}
+
+	if user.InstallationID != 67890 {
+		t.Errorf("Expected installation_id 67890, got %d", user.InstallationID)
+	}
+
+	if user.PrivateKeyPath != keyPath {
+		t.Errorf("Expected private_key_path '%s', got '%s'", keyPath, user.PrivateKeyPath)
+	}
+
+	// The key is read, so a key rotated in place changes the user
+	if string(user.PrivateKey) != "app key" {
+		t.Errorf("Expected the private key to be read, got %q", user.PrivateKey)
+	}
+}
+
+func TestLoadConfig_GitHubAppHCL(t *testing.T) {
+	keyPath := writeKeyFile(t, "app key")
+	content := `
+user {
+  name             = "app-bot"
+  app_id           = 12345
+  installation_id  = 67890
+  private_key_path = "/etc/exporter/app.pem"
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(strings.ReplaceAll(content, "/etc/exporter/app.pem", keyPath))); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Users[0].InstallationID != 67890 {
+		t.Errorf("Expected installation_id 67890, got %d", cfg.Users[0].InstallationID)
+	}
+}
+
+func TestLoadConfig_InvalidGitHubApp(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "missing installation id",
+			content: `
+users:
+  - name: "app-bot"
+    app_id: 12345
+    private_key_path: "/etc/exporter/app.pem"
+`,
+		},
+		{
+			name: "missing private key",
+			content: `
+users:
+  - name: "app-bot"
+    app_id: 12345
+    installation_id: 67890
+`,
+		},
+		{
+			name: "token and app credentials",
+			content: `
+users:
+  - name: "app-bot"
+    token: "test-token"
+    app_id: 12345
+    installation_id: 67890
+    private_key_path: "/etc/exporter/app.pem"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(tt.content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = LoadConfig(tmpfile.Name())
+			if err == nil {
+				t.Error("Expected error for invalid GitHub App credentials, got nil")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_EnterpriseServer(t *testing.T) {
+	content := `
+users:
+  - name: "bot"
+    token: "dotcom-token"
+  - name: "bot"
+    token: "ghes-token"
+    base_url: "https://ghes.example.com/api/v3/"
+    upload_url: "https://ghes.example.com/api/uploads/"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Users[0].Host() != DefaultHost {
+		t.Errorf("Expected host '%s', got '%s'", DefaultHost, cfg.Users[0].Host())
+	}
+
+	if cfg.Users[1].Host() != "ghes.example.com" {
+		t.Errorf("Expected host 'ghes.example.com', got '%s'", cfg.Users[1].Host())
+	}
+
+	if cfg.Users[0].Key() == cfg.Users[1].Key() {
+		t.Errorf("Expected distinct keys for users on different hosts, got '%s'", cfg.Users[0].Key())
+	}
+}
+
+func TestLoadConfig_DuplicateUser(t *testing.T) {
+	content := `
+users:
+  - name: "bot"
+    token: "token1"
+  - name: "bot"
+    token: "token2"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for duplicate user on the same host, got nil")
+	}
+}
+
+func TestLoadConfig_InvalidBaseURL(t *testing.T) {
+	content := `
+users:
+  - name: "bot"
+    token: "token"
+    base_url: "ghes.example.com"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for base_url without scheme, got nil")
+	}
+}
+
+func TestLoadConfig_InvalidMetricLayout(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+metric_layout: "flat"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for unsupported metric layout, got nil")
+	}
+}
+
+func TestLoadConfig_StaleAfterShorterThanPollInterval(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+poll_interval: 60
+stale_after: 30
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for stale_after shorter than poll_interval, got nil")
+	}
+}
+
+func TestLoadConfig_TokenEnv(t *testing.T) {
+	t.Setenv("TEST_GITHUB_TOKEN", "env-token")
+
+	content := `
+users:
+  - name: "test-user"
+    token_env: "TEST_GITHUB_TOKEN"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Users[0].Token != "env-token" {
+		t.Errorf("Expected token 'env-token', got '%s'", cfg.Users[0].Token)
+	}
+}
+
+func TestLoadConfig_TokenEnvNotSet(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token_env: "TEST_GITHUB_TOKEN_UNSET"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Fatal("Expected error for unset token_env variable, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "TEST_GITHUB_TOKEN_UNSET") {
+		t.Errorf("Expected error to name the missing variable, got '%v'", err)
+	}
+}
+
+func TestLoadConfig_TokenFile(t *testing.T) {
+	tokenFile, err := os.CreateTemp("", "token-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+
+	if _, err := tokenFile.Write([]byte("file-token\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokenFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := `
+[[users]]
+name = "test-user"
+token_file = "` + tokenFile.Name() + `"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Users[0].Token != "file-token" {
+		t.Errorf("Expected token 'file-token', got '%s'", cfg.Users[0].Token)
+	}
+}
+
+func TestLoadConfig_TokenFileUnreadable(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token_file: "/nonexistent/token"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Fatal("Expected error for unreadable token_file, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "/nonexistent/token") {
+		t.Errorf("Expected error to name the token file, got '%v'", err)
+	}
+}
+
+func TestLoadConfig_MultipleTokenSources(t *testing.T) {
+	t.Setenv("TEST_GITHUB_TOKEN", "env-token")
+
+	content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+    token_env: "TEST_GITHUB_TOKEN"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for user with more than one token source, got nil")
+	}
+}
+
+func TestLoadConfig_EnvExpansion(t *testing.T) {
+	t.Setenv("TEST_LISTEN_PORT", "9200")
+	t.Setenv("TEST_GITHUB_TOKEN", "expanded-token")
+
+	content := `
+listen_addr = ":${TEST_LISTEN_PORT}"
+
+user {
+  name  = "hcl-user"
+  token = "${TEST_GITHUB_TOKEN}"
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.ListenAddr != ":9200" {
+		t.Errorf("Expected listen_addr ':9200', got '%s'", cfg.ListenAddr)
+	}
+
+	if cfg.Users[0].Token != "expanded-token" {
+		t.Errorf("Expected token 'expanded-token', got '%s'", cfg.Users[0].Token)
+	}
+}
+
+func TestLoadConfigWithoutCredentials(t *testing.T) {
+	for ext, content := range map[string]string{
+		".yaml": `
+users:
+  - name: "inline"
+    token: "${UNSET_GITHUB_TOKEN}"
+  - name: "from-env"
+    token_env: "UNSET_GITHUB_TOKEN"
+  - name: "from-file"
+    token_file: "/nonexistent/token"
+  - name: "app"
+    app_id: 1
+    installation_id: 2
+    private_key_path: "/nonexistent/app.pem"
+`,
+		".hcl": `
+user {
+  name  = "inline"
+  token = "${UNSET_GITHUB_TOKEN}"
+}
+user {
+  name       = "from-file"
+  token_file = "/nonexistent/token"
+}
+`,
+	} {
+		t.Run(ext, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*"+ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := LoadConfig(tmpfile.Name()); err == nil {
+				t.Error("Expected LoadConfig to fail without the secrets")
+			}
+
+			cfg, err := LoadConfigWithoutCredentials(tmpfile.Name())
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			if cfg.Users[0].Token != "${UNSET_GITHUB_TOKEN}" {
+				t.Errorf("Expected the reference to be left alone, got %q", cfg.Users[0].Token)
+			}
+			if cfg.Users[1].Token != "" {
+				t.Errorf("Expected the token file not to be read, got %q", cfg.Users[1].Token)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_EnvExpansionNotSet(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token: "${TEST_GITHUB_TOKEN_UNSET}"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Fatal("Expected error for unset variable, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "TEST_GITHUB_TOKEN_UNSET") {
+		t.Errorf("Expected error to name the missing variable, got '%v'", err)
+	}
+}
+
+func TestLoadConfig_EnvExpansionComments(t *testing.T) {
+	t.Setenv("TEST_GITHUB_TOKEN", "expanded-token")
+
+	content := `
+# broker:
+#   api_tokens: ["${TEST_BROKER_TOKEN_UNSET}"]
+users:
+  - name: "test-user"   # or "${TEST_NAME_UNSET}"
+    token: "${TEST_GITHUB_TOKEN}"
+    base_url: "https://github.example.com/api/v3/#${TEST_GITHUB_TOKEN}"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Expected variables in comments to be ignored, got %v", err)
+	}
+	if cfg.Users[0].Token != "expanded-token" {
+		t.Errorf("Expected token 'expanded-token', got '%s'", cfg.Users[0].Token)
+	}
+	if cfg.Users[0].BaseURL != "https://github.example.com/api/v3/#expanded-token" {
+		t.Errorf("Expected # inside a string to be expanded, got '%s'", cfg.Users[0].BaseURL)
+	}
+}
+
+func TestLoadConfig_Examples(t *testing.T) {
+	t.Setenv("CI_BOT_GITHUB_TOKEN", "ci-token")
+	t.Setenv("SEARCH_BOT_GITHUB_TOKEN", "search-token")
+
+	tokenFile, err := os.CreateTemp("", "token-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	if _, err := tokenFile.WriteString("file-token\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokenFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := writeKeyFile(t, "app key")
+
+	loaded := make(map[string]*Config)
+	for _, ext := range []string{".yaml", ".toml", ".hcl"} {
+		t.Run(ext, func(t *testing.T) {
+			data, err := os.ReadFile("../../config" + ext + ".example")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tmpfile, err := os.CreateTemp("", "config-*"+ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			content := strings.ReplaceAll(string(data), "/run/secrets/release-bot-token", tokenFile.Name())
+			content = strings.ReplaceAll(content, "/etc/github_rate_limit_exporter/release-app.pem", keyPath)
+			if _, err := tmpfile.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if err != nil {
+				t.Fatalf("Failed to load config%s.example: %v", ext, err)
+			}
+			if len(cfg.Users) == 0 {
+				t.Errorf("Expected users in config%s.example", ext)
+			}
+			loaded[ext] = cfg
+		})
+	}
+
+	// The examples show the same configuration in every format
+	for _, ext := range []string{".toml", ".hcl"} {
+		if loaded[ext] != nil && loaded[".yaml"] != nil && !reflect.DeepEqual(loaded[ext], loaded[".yaml"]) {
+			t.Errorf("Expected config%s.example to match config.yaml.example:\n%+v\n%+v", ext, loaded[ext], loaded[".yaml"])
+		}
+	}
+}
+
+func TestLoadConfig_ModulesOnly(t *testing.T) {
+	t.Setenv("TEST_TEAM_TOKEN", "team-token")
+
+	content := `
+module {
+  name      = "team-a"
+  token_env = "TEST_TEAM_TOKEN"
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if len(cfg.Users) != 0 {
+		t.Errorf("Expected 0 users, got %d", len(cfg.Users))
+	}
+
+	if len(cfg.Modules) != 1 || cfg.Modules[0].Token != "team-token" {
+		t.Errorf("Expected module 'team-a' with resolved token, got %+v", cfg.Modules)
+	}
+}
+
+func TestLoadConfig_ModuleMissingToken(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+modules:
+  - name: "team-a"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for module with missing token, got nil")
+	}
+}
+
+func TestLoadConfig_InvalidCollectionMode(t *testing.T) {
+	content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+collection_mode: "push"
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(tmpfile.Name())
+	if err == nil {
+		t.Error("Expected error for unsupported collection mode, got nil")
+	}
+}
+
+func TestLoadConfig_Broker(t *testing.T) {
+	tests := []struct {
+		name    string
+		broker  string
+		wantErr bool
+	}{
+		{"defaults", "broker:\n  api_tokens: [\"ci-secret\"]\n", false},
+		{"no api tokens", "broker:\n  reveal_tokens: true\n", true},
+		{"empty api token", "broker:\n  api_tokens: [\"\"]\n", true},
+		{"negative lease ttl", "broker:\n  api_tokens: [\"ci-secret\"]\n  lease_ttl: -1\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+` + tt.broker
+
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if cfg.Broker.LeaseTTL != 300 {
+				t.Errorf("Expected default lease_ttl 300, got %d", cfg.Broker.LeaseTTL)
+			}
+			if cfg.Broker.LeaseCost != 100 {
+				t.Errorf("Expected default lease_cost 100, got %d", cfg.Broker.LeaseCost)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_BrokerHCL(t *testing.T) {
+	content := `
+user {
+  name  = "test-user"
+  token = "test-token"
+}
+
+broker {
+  api_tokens    = ["ci-secret"]
+  reveal_tokens = true
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if cfg.Broker == nil || !cfg.Broker.RevealTokens {
+		t.Errorf("Expected broker with reveal_tokens, got %+v", cfg.Broker)
+	}
+}
+
+func TestLoadConfig_Proxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		wantErr bool
+	}{
+		{"defaults", "proxy:\n  api_tokens: [\"ci-secret\"]\n", false},
+		{"no api tokens", "proxy:\n  listen_addr: \":9200\"\n", true},
+		{"same listen addr", "proxy:\n  listen_addr: \":9101\"\n  api_tokens: [\"ci-secret\"]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+` + tt.proxy
+
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if cfg.Proxy.ListenAddr != ":9102" {
+				t.Errorf("Expected default proxy listen_addr :9102, got %s", cfg.Proxy.ListenAddr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_UserScheduling(t *testing.T) {
+	content := `
+users:
+  - name: "search-bot"
+    token: "token-a"
+    poll_interval: 15
+    resources: ["search", "core"]
+  - name: "dormant"
+    token: "token-b"
+    poll_interval: 600
+poll_workers: 4
+`
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if cfg.PollWorkers != 4 {
+		t.Errorf("Expected 4 poll workers, got %d", cfg.PollWorkers)
+	}
+	if interval := cfg.Users[0].Interval(cfg.PollInterval); interval != 15 {
+		t.Errorf("Expected interval 15, got %d", interval)
+	}
+	if !cfg.Users[0].ExportsResource("search") || cfg.Users[0].ExportsResource("graphql") {
+		t.Errorf("Expected only search and core exported, got %v", cfg.Users[0].Resources)
+	}
+	if !cfg.Users[1].ExportsResource("graphql") {
+		t.Error("Expected all resources exported without a selection")
+	}
+
+	// stale_after must cover the longest poll interval
+	if err := os.WriteFile(tmpfile.Name(), []byte(content+"stale_after: 300\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(tmpfile.Name()); err == nil {
+		t.Error("Expected error for stale_after shorter than a user's poll_interval, got nil")
+	}
+}
+
+func TestLoadConfig_AdaptivePolling(t *testing.T) {
+	tests := []struct {
+		name     string
+		adaptive string
+		wantErr  bool
+	}{
+		{"defaults", "adaptive_polling: {}\n", false},
+		{"max below min", "adaptive_polling:\n  min_interval: 60\n  max_interval: 30\n", true},
+		{"threshold out of range", "adaptive_polling:\n  thresholds:\n    - remaining: 1.5\n      interval: 10\n", true},
+		{"threshold without interval", "adaptive_polling:\n  thresholds:\n    - remaining: 0.5\n", true},
+		{"stale before max interval", "stale_after: 300\nadaptive_polling: {}\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+users:
+  - name: "test-user"
+    token: "test-token"
+` + tt.adaptive
+
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			a := cfg.AdaptivePolling
+			if a.MinInterval != 10 || a.MaxInterval != 600 || a.ExhaustionHorizon != 900 {
+				t.Errorf("Expected default bounds 10-600 and horizon 900, got %+v", a)
+			}
+			if len(a.Thresholds) != 2 {
+				t.Errorf("Expected 2 default thresholds, got %+v", a.Thresholds)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Labels(t *testing.T) {
+	tests := []struct {
+		name    string
+		ext     string
+		content string
+		wantErr bool
+	}{
+		{"yaml", ".yaml", `
+users:
+  - name: "a"
+    token: "t"
+    labels: {team: "platform", env: "prod"}
+  - name: "b"
+    token: "t"
+    labels: {env: "dev", team: "security"}
+`, false},
+		{"toml", ".toml", `
+[[users]]
+name = "a"
+token = "t"
+labels = { team = "platform", env = "prod" }
+`, false},
+		{"hcl", ".hcl", `
+user {
+  name   = "a"
+  token  = "t"
+  labels = { team = "platform", env = "prod" }
+}
+`, false},
+		{"invalid name", ".yaml", "users:\n  - name: a\n    token: t\n    labels: {\"cost-center\": \"42\"}\n", true},
+		{"double underscore", ".yaml", "users:\n  - name: a\n    token: t\n    labels: {__team: platform}\n", true},
+		{"reserved name", ".yaml", "users:\n  - name: a\n    token: t\n    labels: {resource: core}\n", true},
+		{"inconsistent names", ".yaml", `
+users:
+  - name: "a"
+    token: "t"
+    labels: {team: "platform"}
+  - name: "b"
+    token: "t"
+`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*"+tt.ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(tt.content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			user := cfg.Users[0]
+			if user.Labels["team"] != "platform" || user.Labels["env"] != "prod" {
+				t.Errorf("Expected team and env labels, got %v", user.Labels)
+			}
+			if names := user.LabelNames(); len(names) != 2 || names[0] != "env" || names[1] != "team" {
+				t.Errorf("Expected sorted label names [env team], got %v", names)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Groups(t *testing.T) {
+	users := `
+users:
+  - name: "pool-1"
+    token: "t"
+  - name: "pool-2"
+    token: "t"
+  - name: "pool-2"
+    token: "t"
+    base_url: "https://github.example.com/api/v3/"
+`
+	tests := []struct {
+		name    string
+		groups  string
+		wantErr bool
+	}{
+		{"valid", "groups:\n  - name: ci\n    users: [pool-1, github.example.com/pool-2]\n", false},
+		{"no name", "groups:\n  - users: [pool-1]\n", true},
+		{"duplicate name", "groups:\n  - name: ci\n    users: [pool-1]\n  - name: ci\n    users: [pool-1]\n", true},
+		{"no users", "groups:\n  - name: ci\n", true},
+		{"unknown user", "groups:\n  - name: ci\n    users: [pool-9]\n", true},
+		{"ambiguous user", "groups:\n  - name: ci\n    users: [pool-2]\n", true},
+		{"duplicate user", "groups:\n  - name: ci\n    users: [pool-1, api.github.com/pool-1]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(users + tt.groups)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			group := cfg.Groups[0]
+			if !group.Includes(cfg.Users[0]) || group.Includes(cfg.Users[1]) || !group.Includes(cfg.Users[2]) {
+				t.Errorf("Expected pool-1 and the enterprise pool-2 in the group, got %v", group.Users)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Alerting(t *testing.T) {
+	users := `
+users:
+  - name: "ci-bot"
+    token: "t"
+groups:
+  - name: "ci"
+    users: ["ci-bot"]
+`
+	webhooks := "  webhooks:\n    - url: \"https://hooks.example.com/alerts\"\n"
+	tests := []struct {
+		name     string
+		alerting string
+		wantErr  bool
+	}{
+		{"defaults", "alerting:\n  rules:\n    - name: low\n      remaining_below_percent: 10\n" + webhooks, false},
+		{"user and group", "alerting:\n  rules:\n    - name: low\n      user: ci-bot\n      group: ci\n      remaining_below: 10\n" + webhooks, true},
+		{"unknown user", "alerting:\n  rules:\n    - name: low\n      user: other\n      remaining_below: 10\n" + webhooks, true},
+		{"unknown group", "alerting:\n  rules:\n    - name: low\n      group: other\n      remaining_below: 10\n" + webhooks, true},
+		{"no threshold", "alerting:\n  rules:\n    - name: low\n" + webhooks, true},
+		{"both thresholds", "alerting:\n  rules:\n    - name: low\n      remaining_below: 10\n      remaining_below_percent: 10\n" + webhooks, true},
+		{"percent out of range", "alerting:\n  rules:\n    - name: low\n      remaining_below_percent: 150\n" + webhooks, true},
+		{"duplicate rule", "alerting:\n  rules:\n    - name: low\n      remaining_below: 10\n    - name: low\n      remaining_below: 5\n" + webhooks, true},
+		{"no webhooks", "alerting:\n  rules:\n    - name: low\n      remaining_below: 10\n", true},
+		{"relative webhook url", "alerting:\n  rules:\n    - name: low\n      remaining_below: 10\n  webhooks:\n    - url: \"/alerts\"\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(users + tt.alerting)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			a := cfg.Alerting
+			if a.MaxRetries != 5 || a.QueueSize != 100 || a.Rules[0].Resource != "core" {
+				t.Errorf("Expected default max_retries 5, queue_size 100 and resource core, got %+v", a)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_AlertingHCL(t *testing.T) {
+	content := `
+user {
+  name  = "ci-bot"
+  token = "t"
+}
+
+alerting {
+  rule {
+    name            = "core-low"
+    user            = "ci-bot"
+    remaining_below = 500
+    for             = 300
+  }
+  webhook {
+    url     = "https://hooks.example.com/alerts"
+    headers = { Authorization = "Bearer secret" }
+  }
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rule := cfg.Alerting.Rules[0]
+	if rule.For != 300 || rule.RemainingBelow != 500 || !rule.Matches(cfg.Users[0]) {
+		t.Errorf("Unexpected rule: %+v", rule)
+	}
+	if got := cfg.Alerting.Webhooks[0].Headers["Authorization"]; got != "Bearer secret" {
+		t.Errorf("Expected webhook header, got %q", got)
+	}
+}
+
+func TestLoadConfig_PrometheusRules(t *testing.T) {
+	users := `
+users:
+  - name: "ci-bot"
+    token: "t"
+  - name: "release-app"
+    token: "t"
+`
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{"defaults", "", false},
+		{"overrides", "prometheus_rules:\n  resources:\n    - resource: search\n      warning_percent: 50\n  overrides:\n    - user: release-app\n      warning_percent: 10\n    - user: release-app\n      resource: core\n      for: 60\n", false},
+		{"percent out of range", "prometheus_rules:\n  warning_percent: 150\n", true},
+		{"negative for", "prometheus_rules:\n  resources:\n    - resource: core\n      for: -1\n", true},
+		{"resource without name", "prometheus_rules:\n  resources:\n    - warning_percent: 50\n", true},
+		{"resource with user", "prometheus_rules:\n  resources:\n    - resource: core\n      user: ci-bot\n", true},
+		{"duplicate resource", "prometheus_rules:\n  resources:\n    - resource: core\n    - resource: core\n", true},
+		{"override without user", "prometheus_rules:\n  overrides:\n    - resource: core\n", true},
+		{"unknown user", "prometheus_rules:\n  overrides:\n    - user: other\n", true},
+		{"duplicate override", "prometheus_rules:\n  overrides:\n    - user: ci-bot\n    - user: api.github.com/ci-bot\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			if _, err := tmpfile.Write([]byte(users + tt.rules)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpfile.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(tmpfile.Name())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			r := cfg.PrometheusRules
+			if r.WarningPercent != 20 || r.CriticalPercent != 5 || r.For != 300 {
+				t.Errorf("Expected default thresholds 20%%, 5%% for 300s, got %+v", r)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_PrometheusRulesHCL(t *testing.T) {
+	content := `
+user {
+  name  = "release-app"
+  token = "t"
+}
+
+prometheus_rules {
+  critical_percent = 2
+
+  resource {
+    resource        = "search"
+    warning_percent = 50
+  }
+
+  override {
+    user            = "release-app"
+    resource        = "core"
+    warning_percent = 10
+  }
+}
+`
+	tmpfile, err := os.CreateTemp("", "config-*.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	r := cfg.PrometheusRules
+	if r.CriticalPercent != 2 || r.WarningPercent != 20 {
+		t.Errorf("Expected critical_percent 2 and default warning_percent, got %+v", r)
+	}
+	if len(r.Resources) != 1 || r.Resources[0].WarningPercent != 50 {
+		t.Errorf("Unexpected resources: %+v", r.Resources)
+	}
+	if len(r.Overrides) != 1 || r.Overrides[0].User != "release-app" || r.Overrides[0].Resource != "core" {
+		t.Errorf("Unexpected overrides: %+v", r.Overrides)
+	}
+}
@@ -0,0 +1,228 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/auth"
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+const (
+	// Path is where the endpoint is mounted
+	Path = "/api/v1/rate-limits"
+
+	// maxBodySize bounds a batch
+	maxBodySize = 1 << 20
+
+	// defaultRetryAfter is assumed for reported secondary limits without a
+	// Retry-After, as GitHub asks to wait at least a minute
+	defaultRetryAfter = 60
+)
+
+// Observer takes rate limit states seen outside of polling
+type Observer interface {
+	ObserveQuota(q collector.Quota) error
+	ObserveSecondaryLimit(user config.User, retryAfter time.Duration)
+}
+
+// Observation is the rate limit state of one GitHub API response, as read by
+// the client from the X-RateLimit-* headers
+type Observation struct {
+	User     string `json:"user"`
+	Host     string `json:"host"`
+	Resource string `json:"resource"`
+
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	Used      int   `json:"used"`
+	Reset     int64 `json:"reset"`
+
+	// ObservedAt is when the response was received, defaults to now
+	ObservedAt time.Time `json:"observed_at"`
+
+	// Status and RetryAfter report secondary rate limit hits
+	Status     int `json:"status"`
+	RetryAfter int `json:"retry_after"`
+}
+
+// Batch is the body of a report
+type Batch struct {
+	Observations []Observation `json:"observations"`
+}
+
+// Result tells what became of the observations of a batch
+type Result struct {
+	Accepted int `json:"accepted"`
+	// Stale observations were older than what the exporter already knew
+	Stale  int           `json:"stale"`
+	Errors []resultError `json:"errors,omitempty"`
+}
+
+type resultError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// Handler feeds rate limits that clients saw on their own GitHub API
+// responses into the collector. Only users from the configuration can be
+// reported, and a report only wins over polled data when it is newer.
+type Handler struct {
+	observer Observer
+	cfg      *config.Ingest
+	// users is keyed by user key
+	users map[string]config.User
+
+	// Prometheus metrics
+	observations *prometheus.CounterVec
+
+	mu sync.RWMutex
+}
+
+// NewHandler creates an ingestion endpoint for the users in cfg. A config
+// without an ingest section disables it until one with it is loaded.
+func NewHandler(cfg *config.Config, observer Observer) *Handler {
+	h := &Handler{observer: observer}
+
+	h.observations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_ingested_observations_total",
+			Help: "Total number of reported rate limit observations by result",
+		},
+		[]string{"result"},
+	)
+	for _, result := range []string{"accepted", "stale", "invalid"} {
+		h.observations.WithLabelValues(result)
+	}
+
+	h.Reload(cfg)
+
+	return h
+}
+
+// Reload replaces the users that can be reported
+func (h *Handler) Reload(cfg *config.Config) {
+	users := make(map[string]config.User, len(cfg.Users))
+	for _, user := range cfg.Users {
+		users[user.Key()] = user
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cfg = cfg.Ingest
+	h.users = users
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	cfg, users := h.cfg, h.users
+	h.mu.RUnlock()
+
+	if cfg == nil {
+		http.Error(w, "Ingestion is not configured", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.Authorized(r, cfg.APITokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing or invalid api token", http.StatusUnauthorized)
+		return
+	}
+
+	var batch Batch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&batch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var result Result
+	for i, o := range batch.Observations {
+		err := h.observe(users, o)
+		switch {
+		case err == nil:
+			result.Accepted++
+			h.observations.WithLabelValues("accepted").Inc()
+		case errors.Is(err, collector.ErrStaleQuota):
+			result.Stale++
+			h.observations.WithLabelValues("stale").Inc()
+		default:
+			result.Errors = append(result.Errors, resultError{Index: i, Error: err.Error()})
+			h.observations.WithLabelValues("invalid").Inc()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// observe validates an observation and hands it to the observer
+func (h *Handler) observe(users map[string]config.User, o Observation) error {
+	host := o.Host
+	if host == "" {
+		host = config.DefaultHost
+	}
+	user, ok := users[host+"/"+o.User]
+	if !ok {
+		return fmt.Errorf("unknown user %q on %s", o.User, host)
+	}
+
+	if o.Limit <= 0 || o.Remaining < 0 || o.Used < 0 || o.Reset <= 0 {
+		return fmt.Errorf("limit and reset must be positive, remaining and used must not be negative")
+	}
+
+	// Like the X-RateLimit-Resource header, older GitHub Enterprise Server
+	// releases don't name the bucket
+	resource := o.Resource
+	if resource == "" {
+		resource = "core"
+	}
+	if !collector.KnownResource(resource) {
+		return fmt.Errorf("unknown resource %q", resource)
+	}
+
+	// Without the body, a 403 is only told apart from missing permissions by
+	// its Retry-After; a 429 with requests left can only be a secondary limit
+	if (o.Status == http.StatusTooManyRequests && o.Remaining > 0) ||
+		(o.Status == http.StatusForbidden && o.RetryAfter > 0) {
+		retryAfter := o.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+		h.observer.ObserveSecondaryLimit(user, time.Duration(retryAfter)*time.Second)
+	}
+
+	return h.observer.ObserveQuota(collector.Quota{
+		User:      user,
+		Resource:  resource,
+		Limit:     o.Limit,
+		Remaining: o.Remaining,
+		Used:      o.Used,
+		Reset:     time.Unix(o.Reset, 0),
+		UpdatedAt: o.ObservedAt,
+	})
+}
+
+// Describe implements prometheus.Collector
+func (h *Handler) Describe(ch chan<- *prometheus.Desc) {
+	h.observations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (h *Handler) Collect(ch chan<- prometheus.Metric) {
+	h.observations.Collect(ch)
+}
@@ -0,0 +1,147 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func newTestHandler(t *testing.T) (*Handler, *collector.Collector) {
+	t.Helper()
+
+	cfg := &config.Config{
+		Users:        []config.User{{Name: "ci-bot", Token: "token"}},
+		MetricLayout: config.MetricLayoutResource,
+		Ingest:       &config.Ingest{APITokens: []string{"secret"}},
+	}
+	c, err := collector.NewCollector(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+
+	return NewHandler(cfg, c), c
+}
+
+func post(t *testing.T, h *Handler, body string) (*httptest.ResponseRecorder, Result) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var result Result
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+
+	return rec, result
+}
+
+func TestHandler_Ingest(t *testing.T) {
+	h, c := newTestHandler(t)
+	reset := time.Now().Add(time.Hour).Unix()
+
+	rec, result := post(t, h, fmt.Sprintf(`{"observations": [
+		{"user": "ci-bot", "resource": "core", "limit": 5000, "remaining": 4000, "used": 1000, "reset": %[1]d},
+		{"user": "ci-bot", "resource": "core", "limit": 5000, "remaining": 4100, "used": 900, "reset": %[1]d},
+		{"user": "other", "resource": "core", "limit": 5000, "remaining": 4000, "used": 1000, "reset": %[1]d},
+		{"user": "ci-bot", "resource": "search", "limit": 0, "remaining": 0, "used": 0, "reset": %[1]d},
+		{"user": "ci-bot", "resource": "made_up_bucket", "limit": 10, "remaining": 5, "used": 5, "reset": %[1]d}
+	]}`, reset))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	if result.Accepted != 1 || result.Stale != 1 || len(result.Errors) != 3 {
+		t.Errorf("Expected 1 accepted, 1 stale and 3 errors, got %+v", result)
+	}
+
+	quotas := c.Quotas("core")
+	if len(quotas) != 1 || quotas[0].Remaining != 4000 {
+		t.Errorf("Expected 4000 core requests remaining, got %+v", quotas)
+	}
+
+	if v := testutil.ToFloat64(h.observations.WithLabelValues("invalid")); v != 3 {
+		t.Errorf("Expected 3 invalid observations, got %v", v)
+	}
+}
+
+func TestHandler_IngestDeselectedResource(t *testing.T) {
+	cfg := &config.Config{
+		Users:        []config.User{{Name: "ci-bot", Token: "token", Resources: []string{"core"}}},
+		MetricLayout: config.MetricLayoutResource,
+		Ingest:       &config.Ingest{APITokens: []string{"secret"}},
+	}
+	c, err := collector.NewCollector(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	h := NewHandler(cfg, c)
+
+	_, result := post(t, h, fmt.Sprintf(`{"observations": [
+		{"user": "ci-bot", "resource": "search", "limit": 30, "remaining": 28, "used": 2, "reset": %d}
+	]}`, time.Now().Add(time.Hour).Unix()))
+	if result.Stale != 0 || len(result.Errors) != 1 {
+		t.Errorf("Expected the deselected bucket to be an error, got %+v", result)
+	}
+	if v := testutil.ToFloat64(h.observations.WithLabelValues("invalid")); v != 1 {
+		t.Errorf("Expected 1 invalid observation, got %v", v)
+	}
+	if q := c.Quotas("search"); len(q) != 0 {
+		t.Errorf("Expected no search quota, got %+v", q)
+	}
+}
+
+func TestHandler_IngestSecondaryLimit(t *testing.T) {
+	h, c := newTestHandler(t)
+
+	_, result := post(t, h, fmt.Sprintf(`{"observations": [
+		{"user": "ci-bot", "limit": 5000, "remaining": 4000, "used": 1000, "reset": %d, "status": 429, "retry_after": 30}
+	]}`, time.Now().Add(time.Hour).Unix()))
+	if result.Accepted != 1 {
+		t.Errorf("Expected 1 accepted observation, got %+v", result)
+	}
+
+	expected := `
+# HELP github_secondary_rate_limit_hits_total Total number of responses blocked by a secondary rate limit
+# TYPE github_secondary_rate_limit_hits_total counter
+github_secondary_rate_limit_hits_total{host="api.github.com",user="ci-bot"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_secondary_rate_limit_hits_total"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+}
+
+func TestHandler_IngestRejects(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without api token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec, _ = post(t, h, `not json`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid body, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	h.Reload(&config.Config{Users: []config.User{{Name: "ci-bot", Token: "token"}}})
+	rec, _ = post(t, h, `{}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d when disabled, got %d", http.StatusNotFound, rec.Code)
+	}
+}
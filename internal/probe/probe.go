@@ -0,0 +1,146 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+const (
+	// defaultTimeout is used when Prometheus doesn't send its scrape timeout
+	defaultTimeout = 10 * time.Second
+
+	// timeoutOffset leaves room to write the response before Prometheus gives up
+	timeoutOffset = 500 * time.Millisecond
+)
+
+// Handler serves rate limits fetched on demand for a single account, in the
+// style of blackbox_exporter's /probe endpoint. Each request gets a fresh
+// registry, so service discovery and relabeling decide what gets checked.
+//
+//	/probe?target=<user>   an account from the users list
+//	/probe?module=<name>   an account from the modules list
+//
+// An optional host parameter picks between accounts with the same name on
+// different GitHub hosts.
+//
+// Clients and logins are kept across probes, so probing an account doesn't
+// mint an installation token or look up the login every time.
+type Handler struct {
+	cfg     *config.Config
+	clients *collector.ClientCache
+
+	mu sync.RWMutex
+}
+
+// NewHandler creates a probe handler for the accounts in cfg
+func NewHandler(cfg *config.Config) *Handler {
+	return &Handler{cfg: cfg, clients: collector.NewClientCache()}
+}
+
+// Reload replaces the accounts that can be probed, dropping the clients of
+// removed or changed accounts
+func (h *Handler) Reload(cfg *config.Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cfg = cfg
+	h.clients.Retain(slices.Concat(cfg.Users, cfg.Modules))
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	h.mu.RLock()
+	cfg := h.cfg
+	h.mu.RUnlock()
+
+	var (
+		user config.User
+		err  error
+	)
+	switch {
+	case params.Get("target") != "":
+		user, err = lookup(cfg.Users, "target", params.Get("target"), params.Get("host"))
+	case params.Get("module") != "":
+		user, err = lookup(cfg.Modules, "module", params.Get("module"), params.Get("host"))
+	default:
+		err = fmt.Errorf("target or module parameter is missing")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c, err := collector.NewCachedCollector(&config.Config{
+		Users:        []config.User{user},
+		MetricLayout: cfg.MetricLayout,
+	}, h.clients)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create collector: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r))
+	defer cancel()
+
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Duration of the probe in seconds",
+	})
+
+	start := time.Now()
+	c.Update(ctx)
+	probeDuration.Set(time.Since(start).Seconds())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c, probeDuration)
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// lookup finds an account by name, and by host when given
+func lookup(users []config.User, kind, name, host string) (config.User, error) {
+	var found []config.User
+	for _, user := range users {
+		if user.Name == name && (host == "" || user.Host() == host) {
+			found = append(found, user)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return config.User{}, fmt.Errorf("unknown %s %q", kind, name)
+	case 1:
+		return found[0], nil
+	default:
+		return config.User{}, fmt.Errorf("%s %q exists on several hosts, set the host parameter", kind, name)
+	}
+}
+
+// scrapeTimeout returns the time left for the probe, based on the timeout
+// Prometheus sends along with the scrape
+func scrapeTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return defaultTimeout
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > timeoutOffset {
+		timeout -= timeoutOffset
+	}
+
+	return timeout
+}
@@ -0,0 +1,138 @@
+package probe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// newGitHubServer serves rate limits and the authenticated user, counting the
+// user lookups in logins if not nil
+func newGitHubServer(t *testing.T, logins *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/rate_limit":
+			w.Write([]byte(`{"resources": {"core": {"limit": 5000, "remaining": 4321, "used": 679, "reset": 1700000000}}}`))
+		case "/api/v3/user":
+			if logins != nil {
+				logins.Add(1)
+			}
+			w.Write([]byte(`{"login": "octo-bot"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHandler_Probe(t *testing.T) {
+	server := newGitHubServer(t, nil)
+	h := NewHandler(&config.Config{
+		Users:        []config.User{{Name: "polled", Token: "token", BaseURL: server.URL}},
+		Modules:      []config.User{{Name: "team-a", Token: "token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutLegacy,
+	})
+
+	for _, query := range []string{"target=polled", "module=team-a"} {
+		t.Run(query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?"+query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+
+			body := rec.Body.String()
+			for _, expected := range []string{
+				"github_rate_limit_core_remaining{host=\"127.0.0.1\",user=",
+				"github_rate_limit_up{host=\"127.0.0.1\",user=",
+				"probe_duration_seconds",
+			} {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Expected response to contain %q", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ProbeCachesLogins(t *testing.T) {
+	var logins atomic.Int32
+	server := newGitHubServer(t, &logins)
+	cfg := &config.Config{
+		Users:        []config.User{{Name: "polled", Token: "token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutLegacy,
+	}
+	h := NewHandler(cfg)
+
+	probe := func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target=polled", nil))
+		if !strings.Contains(rec.Body.String(), `login="octo-bot"`) {
+			t.Errorf("Expected the login in the response, got %s", rec.Body.String())
+		}
+	}
+
+	probe()
+	probe()
+	if n := logins.Load(); n != 1 {
+		t.Errorf("Expected the login to be looked up once, got %d lookups", n)
+	}
+
+	// New credentials may belong to another account
+	h.Reload(&config.Config{
+		Users:        []config.User{{Name: "polled", Token: "new-token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutLegacy,
+	})
+	probe()
+	if n := logins.Load(); n != 2 {
+		t.Errorf("Expected the login to be looked up again after new credentials, got %d lookups", n)
+	}
+}
+
+func TestHandler_ProbeUnknownTarget(t *testing.T) {
+	h := NewHandler(&config.Config{
+		Users: []config.User{{Name: "polled", Token: "token"}},
+	})
+
+	for _, query := range []string{"", "target=missing", "module=polled"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?"+query, nil))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %q, got %d", http.StatusBadRequest, query, rec.Code)
+		}
+	}
+}
+
+func TestHandler_ProbeAmbiguousHost(t *testing.T) {
+	h := NewHandler(&config.Config{
+		Users: []config.User{
+			{Name: "bot", Token: "token"},
+			{Name: "bot", Token: "token", BaseURL: "https://ghes.example.com/api/v3/"},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target=bot", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without host, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	user, err := lookup(h.cfg.Users, "target", "bot", "ghes.example.com")
+	if err != nil {
+		t.Fatalf("Expected lookup with host to succeed: %v", err)
+	}
+	if !user.IsEnterprise() {
+		t.Error("Expected the GHES account to be picked")
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/auth"
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Observer learns rate limits from the headers of GitHub API responses
+type Observer interface {
+	// ObserveHeaders returns the bucket the response counted against, or ""
+	// if it carried no rate limit
+	ObserveHeaders(user config.User, header http.Header) string
+	// ObserveSecondaryLimit records a response blocked by a secondary rate limit
+	ObserveSecondaryLimit(user config.User, retryAfter time.Duration)
+}
+
+// Proxy forwards GitHub API requests with the credentials of a configured
+// user and records the rate limits every response reports, including hits of
+// secondary rate limits. Requests are routed by the user's API host and name:
+//
+//	/<host>/<user>/<path>   e.g. /api.github.com/ci-bot/repos/org/repo
+//
+// Callers authenticate with one of the proxy api_tokens, which is replaced
+// by the user's GitHub credentials before the request is forwarded.
+type Proxy struct {
+	observer Observer
+	cfg      *config.Proxy
+
+	// users and transports are keyed by user key
+	users      map[string]config.User
+	transports map[string]http.RoundTripper
+
+	// Prometheus metrics
+	requests *prometheus.CounterVec
+
+	mu sync.Mutex
+}
+
+// New creates a proxy for the users in cfg. A config without a proxy section
+// disables it until one with a proxy section is loaded.
+func New(cfg *config.Config, observer Observer) *Proxy {
+	p := &Proxy{observer: observer}
+
+	p.requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_proxy_requests_total",
+			Help: "Total number of requests forwarded by the proxy by resource and status code",
+		},
+		[]string{"user", "host", "resource", "code"},
+	)
+
+	p.Reload(cfg)
+
+	return p
+}
+
+// Reload replaces the users requests can be made as
+func (p *Proxy) Reload(cfg *config.Config) {
+	users := make(map[string]config.User, len(cfg.Users))
+	for _, user := range cfg.Users {
+		users[user.Key()] = user
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cfg = cfg.Proxy
+	p.users = users
+	// Credentials may have changed
+	p.transports = make(map[string]http.RoundTripper)
+}
+
+// ServeHTTP implements http.Handler
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	cfg := p.cfg
+	p.mu.Unlock()
+
+	if cfg == nil {
+		http.Error(w, "Proxy is not configured", http.StatusNotFound)
+		return
+	}
+
+	if !auth.Authorized(r, cfg.APITokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing or invalid api token", http.StatusUnauthorized)
+		return
+	}
+
+	// /<host>/<user>/<path>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 {
+		http.Error(w, "Expected a path of the form /<host>/<user>/<path>", http.StatusBadRequest)
+		return
+	}
+	var path string
+	if len(parts) == 3 {
+		path = parts[2]
+	}
+
+	user, transport, err := p.lookup(parts[0] + "/" + parts[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Resolve the API URL the way the polling client does, e.g. adding
+	// /api/v3/ for GitHub Enterprise Server
+	client, err := auth.NewClient(user, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid API URL for user %s: %v", user.Name, err), http.StatusInternalServerError)
+		return
+	}
+	target := client.BaseURL
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = "/" + path
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(target)
+			// The transport sets the user's credentials
+			pr.Out.Header.Del("Authorization")
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			resource := p.observer.ObserveHeaders(user, resp.Header)
+			if resource == "" {
+				resource = "none"
+			}
+			p.requests.WithLabelValues(user.Name, user.Host(), resource, strconv.Itoa(resp.StatusCode)).Inc()
+			if retryAfter, ok := collector.SecondaryLimit(resp); ok {
+				p.observer.ObserveSecondaryLimit(user, retryAfter)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy request for user %s on %s failed: %v", user.Name, user.Host(), err)
+			p.requests.WithLabelValues(user.Name, user.Host(), "none", "error").Inc()
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	rp.ServeHTTP(w, r)
+}
+
+// lookup returns a user and a transport that authenticates as it
+func (p *Proxy) lookup(key string) (config.User, http.RoundTripper, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	user, ok := p.users[key]
+	if !ok {
+		return config.User{}, nil, fmt.Errorf("unknown user %q", key)
+	}
+
+	transport, ok := p.transports[key]
+	if !ok {
+		ts, err := auth.TokenSource(user)
+		if err != nil {
+			return config.User{}, nil, fmt.Errorf("failed to create token source for user %q: %w", key, err)
+		}
+		transport = &oauth2.Transport{Source: ts, Base: http.DefaultTransport}
+		p.transports[key] = transport
+	}
+
+	return user, transport, nil
+}
+
+// Describe implements prometheus.Collector
+func (p *Proxy) Describe(ch chan<- *prometheus.Desc) {
+	p.requests.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (p *Proxy) Collect(ch chan<- prometheus.Metric) {
+	p.requests.Collect(ch)
+}
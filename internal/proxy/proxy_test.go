@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func TestProxy_Forward(t *testing.T) {
+	var gotPath, gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.URL.RequestURI(), r.Header.Get("Authorization")
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4000")
+		w.Header().Set("X-RateLimit-Used", "1000")
+		w.Header().Set("X-RateLimit-Reset", "1700000000")
+		w.Header().Set("X-RateLimit-Resource", "core")
+		w.Write([]byte(`{"full_name": "org/repo"}`))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Users:        []config.User{{Name: "ci-bot", Token: "github-token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutResource,
+		Proxy:        &config.Proxy{APITokens: []string{"secret"}},
+	}
+	c, err := collector.NewCollector(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	p := New(cfg, c)
+
+	req := httptest.NewRequest(http.MethodGet, "/127.0.0.1/ci-bot/repos/org/repo?per_page=1", nil)
+	req.Header.Set("Authorization", "token secret")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if gotPath != "/api/v3/repos/org/repo?per_page=1" {
+		t.Errorf("Expected request to /api/v3/repos/org/repo?per_page=1, got %s", gotPath)
+	}
+	if gotAuth != "Bearer github-token" {
+		t.Errorf("Expected the user's GitHub token, got %q", gotAuth)
+	}
+
+	if count := testutil.ToFloat64(p.requests.WithLabelValues("ci-bot", "127.0.0.1", "core", "200")); count != 1 {
+		t.Errorf("Expected 1 proxied request, got %v", count)
+	}
+
+	expected := `
+# HELP github_rate_limit_remaining GitHub API rate limit remaining
+# TYPE github_rate_limit_remaining gauge
+github_rate_limit_remaining{host="127.0.0.1",resource="core",user="ci-bot"} 4000
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "github_rate_limit_remaining"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+}
+
+func TestProxy_Rejects(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{{Name: "ci-bot", Token: "github-token"}},
+		Proxy: &config.Proxy{APITokens: []string{"secret"}},
+	}
+	p := New(cfg, nil)
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+	}{
+		{"no api token", "/api.github.com/ci-bot/user", "", http.StatusUnauthorized},
+		{"wrong api token", "/api.github.com/ci-bot/user", "Bearer wrong", http.StatusUnauthorized},
+		{"unknown user", "/api.github.com/other/user", "Bearer secret", http.StatusNotFound},
+		{"unknown host", "/ghes.example.com/ci-bot/user", "Bearer secret", http.StatusNotFound},
+		{"no user", "/api.github.com", "Bearer secret", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestProxy_SecondaryLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Users:        []config.User{{Name: "ci-bot", Token: "github-token", BaseURL: server.URL}},
+		MetricLayout: config.MetricLayoutResource,
+		Proxy:        &config.Proxy{APITokens: []string{"secret"}},
+	}
+	c, err := collector.NewCollector(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	p := New(cfg, c)
+
+	req := httptest.NewRequest(http.MethodPost, "/127.0.0.1/ci-bot/repos/org/repo/issues", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	expected := `
+# HELP github_secondary_rate_limit_hits_total Total number of responses blocked by a secondary rate limit
+# TYPE github_secondary_rate_limit_hits_total counter
+github_secondary_rate_limit_hits_total{host="127.0.0.1",user="ci-bot"} 1
+# HELP github_secondary_rate_limit_retry_after_seconds Seconds GitHub asked to wait after the last secondary rate limit hit
+# TYPE github_secondary_rate_limit_retry_after_seconds gauge
+github_secondary_rate_limit_retry_after_seconds{host="127.0.0.1",user="ci-bot"} 60
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"github_secondary_rate_limit_hits_total", "github_secondary_rate_limit_retry_after_seconds"); err != nil {
+		t.Errorf("Unexpected collector state: %v", err)
+	}
+}
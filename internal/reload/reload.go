@@ -0,0 +1,122 @@
+package reload
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// ApplyFunc applies a freshly loaded configuration
+type ApplyFunc func(cfg *config.Config) error
+
+// Reloader re-reads the configuration file and hands it to an ApplyFunc,
+// recording the outcome as Prometheus metrics
+type Reloader struct {
+	path  string
+	apply ApplyFunc
+
+	// Prometheus metrics
+	lastReloadSuccessful prometheus.Gauge
+	lastReloadSuccess    prometheus.Gauge
+	reloads              *prometheus.CounterVec
+
+	mu sync.Mutex
+}
+
+// NewReloader creates a reloader for the configuration file at path
+func NewReloader(path string, apply ApplyFunc) *Reloader {
+	r := &Reloader{
+		path:  path,
+		apply: apply,
+	}
+
+	r.lastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		},
+	)
+
+	r.lastReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
+
+	r.reloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_exporter_config_reloads_total",
+			Help: "Total number of configuration reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	// The configuration loaded at startup counts as a successful load
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccess.SetToCurrentTime()
+	r.reloads.WithLabelValues("success")
+	r.reloads.WithLabelValues("failure")
+
+	return r
+}
+
+// Reload loads the configuration file and applies it
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := config.LoadConfig(r.path)
+	if err == nil {
+		err = r.apply(cfg)
+	}
+
+	if err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+		r.lastReloadSuccessful.Set(0)
+		r.reloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	log.Printf("Reloaded configuration with %d users", len(cfg.Users))
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccess.Set(float64(time.Now().Unix()))
+	r.reloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// ServeHTTP triggers a reload on POST requests
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.Reload(); err != nil {
+		http.Error(w, "Failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Describe implements prometheus.Collector
+func (r *Reloader) Describe(ch chan<- *prometheus.Desc) {
+	r.lastReloadSuccessful.Describe(ch)
+	r.lastReloadSuccess.Describe(ch)
+	r.reloads.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (r *Reloader) Collect(ch chan<- prometheus.Metric) {
+	r.lastReloadSuccessful.Collect(ch)
+	r.lastReloadSuccess.Collect(ch)
+	r.reloads.Collect(ch)
+}
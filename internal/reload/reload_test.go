@@ -0,0 +1,202 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tmpfile.Name()
+}
+
+func TestReloader_Reload(t *testing.T) {
+	path := writeConfig(t, `
+users:
+  - name: "test-user"
+    token: "test-token"
+`)
+
+	var applied *config.Config
+	r := NewReloader(path, func(cfg *config.Config) error {
+		applied = cfg
+		return nil
+	})
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if applied == nil || applied.Users[0].Name != "test-user" {
+		t.Fatalf("Expected configuration to be applied, got %+v", applied)
+	}
+
+	if v := testutil.ToFloat64(r.reloads.WithLabelValues("success")); v != 1 {
+		t.Errorf("Expected 1 successful reload, got %v", v)
+	}
+}
+
+func TestReloader_ReloadFailure(t *testing.T) {
+	path := writeConfig(t, `
+users:
+  - name: "test-user"
+    token: "test-token"
+`)
+
+	r := NewReloader(path, func(cfg *config.Config) error {
+		return errors.New("boom")
+	})
+
+	if err := r.Reload(); err == nil {
+		t.Error("Expected error when applying fails, got nil")
+	}
+
+	if v := testutil.ToFloat64(r.lastReloadSuccessful); v != 0 {
+		t.Errorf("Expected last reload to be unsuccessful, got %v", v)
+	}
+
+	if v := testutil.ToFloat64(r.reloads.WithLabelValues("failure")); v != 1 {
+		t.Errorf("Expected 1 failed reload, got %v", v)
+	}
+}
+
+func TestReloader_ServeHTTP(t *testing.T) {
+	path := writeConfig(t, `
+users:
+  - name: "test-user"
+    token: "test-token"
+`)
+
+	r := NewReloader(path, func(cfg *config.Config) error { return nil })
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d for GET, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d for POST, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestReloader_WatchSymlinkSwap(t *testing.T) {
+	// Mimic a Kubernetes Secret mount: config.yaml -> ..data/config.yaml,
+	// with ..data pointing at a timestamped directory that gets swapped
+	dir := t.TempDir()
+	for _, name := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "v1", "config.yaml"), []byte("users:\n  - name: old\n    token: t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "v2", "config.yaml"), []byte("users:\n  - name: new\n    token: t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan string, 10)
+	r := NewReloader(filepath.Join(dir, "config.yaml"), func(cfg *config.Config) error {
+		applied <- cfg.Users[0].Name
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	// Give the watcher time to record the initial content
+	time.Sleep(50 * time.Millisecond)
+
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink("v2", tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case name := <-applied:
+		if name != "new" {
+			t.Errorf("Expected reloaded user 'new', got '%s'", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected configuration to be reloaded after symlink swap")
+	}
+
+	// Unchanged content must not trigger further reloads
+	time.Sleep(50 * time.Millisecond)
+	if len(applied) != 0 {
+		t.Errorf("Expected a single reload, got %d more", len(applied))
+	}
+}
+
+func TestReloader_WatchTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("old-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, "users:\n  - name: bot\n    token_file: "+tokenFile+"\n")
+
+	applied := make(chan string, 10)
+	r := NewReloader(path, func(cfg *config.Config) error {
+		applied <- cfg.Users[0].Token
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	// Give the watcher time to record the initial content
+	time.Sleep(50 * time.Millisecond)
+
+	// A token rotated in the mounted Secret leaves the config file as it is
+	if err := os.WriteFile(tokenFile, []byte("new-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case token := <-applied:
+		if token != "new-token" {
+			t.Errorf("Expected reloaded token 'new-token', got '%s'", token)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected configuration to be reloaded after the token file changed")
+	}
+}
@@ -0,0 +1,90 @@
+package reload
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Watch polls the configuration file and reloads it when its content, or that
+// of a token file or private key it references, changes.
+//
+// Polling the content rather than relying on file events makes it work for
+// Kubernetes Secret and ConfigMap mounts, where kubelet swaps a ..data symlink
+// instead of writing the file the path points to. A change is only applied
+// once the content is the same on two consecutive checks, which debounces
+// editors and tools that write files in several steps.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	current, err := r.checksum()
+	if err != nil {
+		log.Printf("Failed to read configuration for watching: %v", err)
+	}
+
+	var pending []byte
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping configuration watcher")
+			return
+		case <-ticker.C:
+			sum, err := r.checksum()
+			if err != nil {
+				// The file may be missing for a moment during a symlink swap
+				continue
+			}
+
+			switch {
+			case string(sum) == string(current):
+				pending = nil
+			case string(sum) != string(pending):
+				pending = sum
+			default:
+				log.Printf("Configuration file %s changed, reloading", r.path)
+				// A failed reload is retried only when the file changes again
+				current, pending = sum, nil
+				r.Reload()
+			}
+		}
+	}
+}
+
+// checksum returns a hash of the configuration file content and of the token
+// files and private keys it references, following symlinks
+func (r *Reloader) checksum() ([]byte, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write(data)
+
+	// A configuration that doesn't load is rejected by the reload anyway
+	cfg, err := config.LoadConfigWithoutCredentials(r.path)
+	if err != nil {
+		return h.Sum(nil), nil
+	}
+	for _, user := range slices.Concat(cfg.Users, cfg.Modules) {
+		for _, path := range []string{user.TokenFile, user.PrivateKeyPath} {
+			if path == "" {
+				continue
+			}
+			// A missing file is a change too, until it's back
+			secret, _ := os.ReadFile(path)
+			sum := sha256.Sum256(secret)
+			h.Write([]byte(path))
+			h.Write(sum[:])
+		}
+	}
+
+	return h.Sum(nil), nil
+}
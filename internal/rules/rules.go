@@ -0,0 +1,237 @@
+// Package rules generates Prometheus alert rules from the exporter
+// configuration, so thresholds follow the buckets and accounts it monitors
+package rules
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/collector"
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+// Output formats
+const (
+	// FormatRules is a rules file loaded by Prometheus through rule_files
+	FormatRules = "rules"
+	// FormatPrometheusRule is a Prometheus Operator PrometheusRule resource
+	FormatPrometheusRule = "prometheusrule"
+)
+
+// GroupName is the name of the generated rule group
+const GroupName = "github_rate_limit_exporter"
+
+// RuleGroup is a group of Prometheus rules
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a Prometheus alerting rule
+type Rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// File is a Prometheus rules file
+type File struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// PrometheusRule is a Prometheus Operator PrometheusRule resource
+type PrometheusRule struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Metadata   Metadata `yaml:"metadata"`
+	Spec       File     `yaml:"spec"`
+}
+
+// Metadata is the Kubernetes object metadata of a PrometheusRule
+type Metadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+// NewPrometheusRule wraps rule groups in a PrometheusRule resource
+func NewPrometheusRule(meta Metadata, groups ...RuleGroup) PrometheusRule {
+	return PrometheusRule{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "PrometheusRule",
+		Metadata:   meta,
+		Spec:       File{Groups: groups},
+	}
+}
+
+// Encode writes a rules file or PrometheusRule as YAML
+func Encode(w io.Writer, v any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Generate returns a warning and a critical rule for every bucket exported
+// for a user or module. Each overridden user gets rules of its own and is left
+// out of the bucket's.
+func Generate(cfg *config.Config) (RuleGroup, error) {
+	pr := cfg.PrometheusRules
+	known := collector.Resources()
+	for _, t := range slices.Concat(pr.Resources, pr.Overrides) {
+		if t.Resource != "" && !slices.Contains(known, t.Resource) {
+			return RuleGroup{}, fmt.Errorf("prometheus_rules: unknown resource %q", t.Resource)
+		}
+	}
+
+	accounts := slices.Concat(cfg.Users, cfg.Modules)
+	group := RuleGroup{Name: GroupName}
+	for _, res := range known {
+		if !slices.ContainsFunc(accounts, func(u config.User) bool { return u.ExportsResource(res) }) {
+			continue
+		}
+
+		base := bucketThresholds(pr, res)
+		var overridden []config.User
+		var userRules []Rule
+		for _, user := range cfg.Users {
+			if !user.ExportsResource(res) {
+				continue
+			}
+			if t, ok := userThresholds(pr, user, base); ok {
+				overridden = append(overridden, user)
+				userRules = append(userRules, alertRules(cfg.MetricLayout, t, accountMatchers(user), nil)...)
+			}
+		}
+
+		group.Rules = append(group.Rules, alertRules(cfg.MetricLayout, base, nil, overridden)...)
+		group.Rules = append(group.Rules, userRules...)
+	}
+	return group, nil
+}
+
+// inherit fills the unset thresholds of t from parent
+func inherit(t, parent config.RuleThresholds) config.RuleThresholds {
+	if t.WarningPercent == 0 {
+		t.WarningPercent = parent.WarningPercent
+	}
+	if t.CriticalPercent == 0 {
+		t.CriticalPercent = parent.CriticalPercent
+	}
+	if t.For == 0 {
+		t.For = parent.For
+	}
+	t.Resource = parent.Resource
+	return t
+}
+
+// bucketThresholds returns the thresholds of a bucket
+func bucketThresholds(pr *config.PrometheusRules, resource string) config.RuleThresholds {
+	t := config.RuleThresholds{
+		Resource:        resource,
+		WarningPercent:  pr.WarningPercent,
+		CriticalPercent: pr.CriticalPercent,
+		For:             pr.For,
+	}
+	for _, o := range pr.Resources {
+		if o.Resource == resource {
+			t = inherit(o, t)
+		}
+	}
+	return t
+}
+
+// userThresholds returns the thresholds of a user's bucket, if overridden.
+// Overrides of the bucket take precedence over overrides of every bucket.
+func userThresholds(pr *config.PrometheusRules, user config.User, base config.RuleThresholds) (config.RuleThresholds, bool) {
+	t, ok := base, false
+	for _, resource := range []string{"", base.Resource} {
+		for _, o := range pr.Overrides {
+			if o.Resource == resource && (o.User == user.Name || o.User == user.Key()) {
+				t, ok = inherit(o, t), true
+			}
+		}
+	}
+	return t, ok
+}
+
+// alertRules returns the warning and critical rule of a bucket, for the
+// accounts selected by matchers except the excluded ones
+func alertRules(layout string, t config.RuleThresholds, matchers []string, excluded []config.User) []Rule {
+	percent := fmt.Sprintf("100 * %s / (%s > 0)",
+		selector(layout, t.Resource, "remaining", matchers),
+		selector(layout, t.Resource, "limit", matchers))
+
+	var unless strings.Builder
+	for _, user := range excluded {
+		unless.WriteString("\nunless on(user, host) " + selector(layout, t.Resource, "remaining", accountMatchers(user)))
+	}
+
+	rule := func(alert, severity, state string, threshold float64) Rule {
+		value := strconv.FormatFloat(threshold, 'f', -1, 64)
+		return Rule{
+			Alert: alert,
+			Expr:  percent + " < " + value + unless.String(),
+			For:   duration(t.For),
+			Labels: map[string]string{
+				"severity":  severity,
+				"component": "github_api",
+				"resource":  t.Resource,
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("GitHub %s rate limit %s for {{ $labels.user }}", t.Resource, state),
+				"description": fmt.Sprintf("User {{ $labels.user }} on {{ $labels.host }} has {{ $value | humanize }}%% of its %s rate limit remaining, below %s%%.",
+					t.Resource, value),
+			},
+		}
+	}
+
+	return []Rule{
+		rule("GitHubRateLimitLow", "warning", "low", t.WarningPercent),
+		rule("GitHubRateLimitCritical", "critical", "critical", t.CriticalPercent),
+	}
+}
+
+// selector returns the series of a bucket's value, e.g. remaining, in the
+// configured metric layout. The resource layout is preferred when both are
+// exported.
+func selector(layout, resource, value string, matchers []string) string {
+	name := "github_rate_limit_" + resource + "_" + value
+	if layout != config.MetricLayoutLegacy {
+		name = "github_rate_limit_" + value
+		matchers = append([]string{"resource=" + strconv.Quote(resource)}, matchers...)
+	}
+
+	if len(matchers) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// accountMatchers returns the label matchers selecting a user's series
+func accountMatchers(user config.User) []string {
+	return []string{"user=" + strconv.Quote(user.Name), "host=" + strconv.Quote(user.Host())}
+}
+
+// duration formats seconds as a Prometheus duration
+func duration(seconds int) string {
+	switch {
+	case seconds == 0:
+		return ""
+	case seconds%3600 == 0:
+		return fmt.Sprintf("%dh", seconds/3600)
+	case seconds%60 == 0:
+		return fmt.Sprintf("%dm", seconds/60)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
@@ -0,0 +1,140 @@
+package rules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/l13t/github_rate_limit_exporter/internal/config"
+)
+
+func newTestConfig(layout string, users ...config.User) *config.Config {
+	return &config.Config{
+		Users:        users,
+		MetricLayout: layout,
+		PrometheusRules: &config.PrometheusRules{
+			WarningPercent:  20,
+			CriticalPercent: 5,
+			For:             300,
+		},
+	}
+}
+
+// find returns the rules of an alert for a bucket
+func find(group RuleGroup, alert, resource string) []Rule {
+	var found []Rule
+	for _, rule := range group.Rules {
+		if rule.Alert == alert && rule.Labels["resource"] == resource {
+			found = append(found, rule)
+		}
+	}
+	return found
+}
+
+func TestGenerate_Overrides(t *testing.T) {
+	cfg := newTestConfig(config.MetricLayoutLegacy,
+		config.User{Name: "ci-bot", Token: "t", Resources: []string{"core", "search"}},
+		config.User{Name: "release-app", Token: "t", Resources: []string{"core"}},
+	)
+	cfg.PrometheusRules.Resources = []config.RuleThresholds{{Resource: "search", WarningPercent: 50, For: 60}}
+	cfg.PrometheusRules.Overrides = []config.RuleThresholds{
+		{User: "release-app", WarningPercent: 10},
+		{User: "api.github.com/release-app", Resource: "core", CriticalPercent: 1},
+	}
+
+	group, err := Generate(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(group.Rules) != 6 {
+		t.Fatalf("Expected 2 rules for each bucket and the override, got %d", len(group.Rules))
+	}
+
+	core := find(group, "GitHubRateLimitLow", "core")
+	if len(core) != 2 {
+		t.Fatalf("Expected a bucket and a user warning for core, got %+v", core)
+	}
+	want := "100 * github_rate_limit_core_remaining / (github_rate_limit_core_limit > 0) < 20\n" +
+		`unless on(user, host) github_rate_limit_core_remaining{user="release-app",host="api.github.com"}`
+	if core[0].Expr != want || core[0].For != "5m" || core[0].Labels["severity"] != "warning" {
+		t.Errorf("Unexpected bucket rule: %+v", core[0])
+	}
+	want = `100 * github_rate_limit_core_remaining{user="release-app",host="api.github.com"} / ` +
+		`(github_rate_limit_core_limit{user="release-app",host="api.github.com"} > 0) < 10`
+	if core[1].Expr != want {
+		t.Errorf("Expected the user override, got %q", core[1].Expr)
+	}
+
+	critical := find(group, "GitHubRateLimitCritical", "core")
+	if len(critical) != 2 || critical[1].Labels["severity"] != "critical" {
+		t.Fatalf("Expected a bucket and a user critical rule for core, got %+v", critical)
+	}
+	if !strings.HasSuffix(critical[1].Expr, " < 1") {
+		t.Errorf("Expected the bucket override to win, got %q", critical[1].Expr)
+	}
+
+	search := find(group, "GitHubRateLimitLow", "search")
+	if len(search) != 1 || search[0].For != "1m" ||
+		search[0].Expr != "100 * github_rate_limit_search_remaining / (github_rate_limit_search_limit > 0) < 50" {
+		t.Errorf("Expected the search thresholds, got %+v", search)
+	}
+}
+
+func TestGenerate_ResourceLayout(t *testing.T) {
+	cfg := newTestConfig(config.MetricLayoutBoth,
+		config.User{Name: "ci-bot", Token: "t", BaseURL: "https://github.example.com/api/v3/", Resources: []string{"graphql"}},
+	)
+	cfg.PrometheusRules.Overrides = []config.RuleThresholds{{User: "ci-bot", WarningPercent: 30}}
+
+	group, err := Generate(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rules := find(group, "GitHubRateLimitLow", "graphql")
+	if len(group.Rules) != 4 || len(rules) != 2 {
+		t.Fatalf("Expected rules for graphql only, got %+v", group.Rules)
+	}
+	want := `100 * github_rate_limit_remaining{resource="graphql"} / (github_rate_limit_limit{resource="graphql"} > 0) < 20` + "\n" +
+		`unless on(user, host) github_rate_limit_remaining{resource="graphql",user="ci-bot",host="github.example.com"}`
+	if rules[0].Expr != want {
+		t.Errorf("Expected %q, got %q", want, rules[0].Expr)
+	}
+}
+
+func TestGenerate_UnknownResource(t *testing.T) {
+	cfg := newTestConfig(config.MetricLayoutLegacy, config.User{Name: "ci-bot", Token: "t"})
+	cfg.PrometheusRules.Resources = []config.RuleThresholds{{Resource: "nonexistent"}}
+
+	if _, err := Generate(cfg); err == nil {
+		t.Error("Expected error for unknown resource")
+	}
+}
+
+func TestEncode_PrometheusRule(t *testing.T) {
+	group, err := Generate(newTestConfig(config.MetricLayoutLegacy, config.User{Name: "ci-bot", Token: "t", Resources: []string{"core"}}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	meta := Metadata{Name: "github-rate-limit-exporter", Namespace: "monitoring", Labels: map[string]string{"release": "prometheus"}}
+	if err := Encode(&buf, NewPrometheusRule(meta, group)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var decoded PrometheusRule
+	if err := yaml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Expected valid YAML, got %v", err)
+	}
+	if decoded.APIVersion != "monitoring.coreos.com/v1" || decoded.Kind != "PrometheusRule" ||
+		decoded.Metadata.Labels["release"] != "prometheus" {
+		t.Errorf("Unexpected resource: %+v", decoded)
+	}
+	if len(decoded.Spec.Groups) != 1 || len(decoded.Spec.Groups[0].Rules) != 2 ||
+		decoded.Spec.Groups[0].Rules[0].Expr != group.Rules[0].Expr {
+		t.Errorf("Expected the rules to round-trip, got %+v", decoded.Spec.Groups)
+	}
+}